@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hydazz/crowdsec-exporter/internal/config"
+	"github.com/hydazz/crowdsec-exporter/internal/crowdsec"
+	"github.com/spf13/cobra"
+)
+
+func newRegisterCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "register",
+		Short: "Register the machine with LAPI using the registration token",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			_, client, err := newClient()
+			if err != nil {
+				return err
+			}
+
+			ctx, cancel := client.RequestContext(cmd.Context())
+			defer cancel()
+
+			status, err := client.Register(ctx)
+			if err != nil {
+				return lapiError("register", err)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "machine %s %s\n", client.MachineID(), status)
+			return nil
+		},
+	}
+}
+
+func newDeregisterCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "deregister",
+		Short: "Remove the machine from LAPI",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			_, client, err := newClient()
+			if err != nil {
+				return err
+			}
+
+			ctx, cancel := client.RequestContext(cmd.Context())
+			defer cancel()
+
+			machineID := client.MachineID()
+			if err := client.Deregister(ctx); err != nil {
+				return lapiError("deregister", err)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "machine %s deregistered\n", machineID)
+			return nil
+		},
+	}
+}
+
+func newWhoamiCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "whoami",
+		Short: "Log in to LAPI and show the machine identity",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			cfg, client, err := newClient()
+			if err != nil {
+				return err
+			}
+
+			ctx, cancel := client.RequestContext(cmd.Context())
+			defer cancel()
+
+			// Certificate-authenticated agents have no login, LAPI names them after the certificate
+			machineID := client.MachineID()
+			if cfg.CrowdSec.AuthMode() == config.AuthModeTLS {
+				name, err := certificateName(cfg.CrowdSec.TLS.CertFile)
+				if err != nil {
+					return &exitError{exitConfig, err}
+				}
+				machineID = fmt.Sprintf("%s (certificate)", name)
+			}
+
+			if err := client.Login(ctx); err != nil {
+				return lapiError("login", err)
+			}
+			out := cmd.OutOrStdout()
+			fmt.Fprintf(out, "machine_id: %s\n", machineID)
+			fmt.Fprintf(out, "token_expire: %s\n", client.Expire().Format(time.RFC3339))
+			fmt.Fprintf(out, "url: %s\n", cfg.CrowdSec.URL)
+			return nil
+		},
+	}
+}
+
+// certificateName returns the subject common name of the client certificate in path
+func certificateName(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read client certificate: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", fmt.Errorf("no certificate found in %s", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("parse client certificate: %w", err)
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// lapiError maps a failed machine operation to its exit code
+func lapiError(op string, err error) error {
+	code := exitLAPI
+	if errors.Is(err, crowdsec.ErrAuthMode) {
+		code = exitConfig
+	}
+	return &exitError{code, fmt.Errorf("%s: %w", op, err)}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestMachineCommands ensures register, deregister and whoami report their outcome and exit code.
+func TestMachineCommands(t *testing.T) {
+	lapi := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/watchers/login":
+			var creds struct {
+				MachineID string `json:"machine_id"`
+				Password  string `json:"password"`
+			}
+			json.NewDecoder(r.Body).Decode(&creds)
+			// Certificate-authenticated agents send no credentials
+			certificate := creds.MachineID == "" && creds.Password == ""
+			if !certificate && (creds.MachineID != "agent" || creds.Password != "secret") {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"message":"incorrect Username or Password"}`))
+				return
+			}
+			w.Write([]byte(`{"token":"token","expire":"2099-01-01T00:00:00Z"}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/watchers":
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodDelete && r.URL.Path == "/v1/watchers/agent":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(lapi.Close)
+
+	certFile, keyFile := writeClientCertificate(t, "agent")
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantOut  string
+		wantCode int
+	}{
+		{
+			name:    "register",
+			args:    []string{"register", "--crowdsec-login", "newcomer", "--crowdsec-password", "secret", "--crowdsec-registration-token", "token"},
+			wantOut: "machine newcomer registered\n",
+		},
+		{
+			name:     "register without a registration token",
+			args:     []string{"register", "--crowdsec-login", "agent", "--crowdsec-password", "secret"},
+			wantCode: exitConfig,
+		},
+		{
+			name:    "deregister",
+			args:    []string{"deregister", "--crowdsec-login", "agent", "--crowdsec-password", "secret"},
+			wantOut: "machine agent deregistered\n",
+		},
+		{
+			name:     "deregister with a bouncer key",
+			args:     []string{"deregister", "--crowdsec-api-key", "key"},
+			wantCode: exitConfig,
+		},
+		{
+			name:    "whoami",
+			args:    []string{"whoami", "--crowdsec-login", "agent", "--crowdsec-password", "secret"},
+			wantOut: "machine_id: agent\ntoken_expire: 2099-01-01T00:00:00Z\nurl: " + lapi.URL + "\n",
+		},
+		{
+			name:    "whoami with a certificate",
+			args:    []string{"whoami", "--crowdsec-cert-file", certFile, "--crowdsec-key-file", keyFile},
+			wantOut: "machine_id: agent (certificate)\ntoken_expire: 2099-01-01T00:00:00Z\nurl: " + lapi.URL + "\n",
+		},
+		{
+			name:     "whoami with a wrong password",
+			args:     []string{"whoami", "--crowdsec-login", "agent", "--crowdsec-password", "wrong"},
+			wantCode: exitLAPI,
+		},
+		{
+			name:     "whoami with a bouncer key",
+			args:     []string{"whoami", "--crowdsec-api-key", "key"},
+			wantCode: exitConfig,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			cmd := newRootCmd()
+			cmd.SetOut(&out)
+			cmd.SetArgs(append(tt.args, "--crowdsec-url", lapi.URL, "--crowdsec-retries", "0", "--log-level", "error"))
+
+			code := 0
+			if err := cmd.Execute(); err != nil {
+				var ee *exitError
+				if !errors.As(err, &ee) {
+					t.Fatalf("expected an exit code, got %v", err)
+				}
+				code = ee.code
+			}
+			if code != tt.wantCode {
+				t.Fatalf("expected exit code %d, got %d", tt.wantCode, code)
+			}
+			if got := out.String(); got != tt.wantOut {
+				t.Fatalf("unexpected output:\n%s\nwant:\n%s", got, tt.wantOut)
+			}
+		})
+	}
+}
+
+// writeClientCertificate writes a self-signed client certificate for name and its key
+func writeClientCertificate(t *testing.T, name string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "agent.pem")
+	keyFile = filepath.Join(dir, "agent-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	return certFile, keyFile
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -14,7 +15,7 @@ import (
 	"github.com/hydazz/crowdsec-exporter/internal/config"
 	"github.com/hydazz/crowdsec-exporter/internal/crowdsec"
 	"github.com/hydazz/crowdsec-exporter/internal/exporter"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -25,10 +26,32 @@ var (
 	date    = "unknown"
 )
 
+// Exit codes reported to scripts
+const (
+	exitFailure = 1 // unexpected error
+	exitConfig  = 2 // invalid configuration
+	exitLAPI    = 3 // LAPI rejected or failed the operation
+)
+
+// exitError carries the process exit code for a failed command
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
 func main() {
 	if err := newRootCmd().Execute(); err != nil {
 		slog.Error("command failed", "error", err)
-		os.Exit(1)
+
+		code := exitFailure
+		var ee *exitError
+		if errors.As(err, &ee) {
+			code = ee.code
+		}
+		os.Exit(code)
 	}
 }
 
@@ -48,29 +71,112 @@ func newRootCmd() *cobra.Command {
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
 
-	f := cmd.Flags()
-	f.String("crowdsec-url", "http://localhost:8080", "CrowdSec Local API URL")
+	// Persistent so the machine management subcommands share the connection settings
+	f := cmd.PersistentFlags()
+	f.String("crowdsec-url", "http://localhost:8080", "CrowdSec Local API URL (http://, https:// or unix:///path/to/socket)")
+	f.String("crowdsec-credentials-file", "", "CrowdSec local_api_credentials.yaml to read url, login, password and certificates from")
 	f.String("crowdsec-login", "", "CrowdSec machine login")
 	f.String("crowdsec-password", "", "CrowdSec machine password")
+	f.String("crowdsec-password-file", "", "File containing the CrowdSec machine password, re-read on change")
 	f.String("crowdsec-registration-token", "", "CrowdSec auto-registration token")
-	f.String("crowdsec-machine-name", "", "Machine name for auto-registration (defaults to hostname)")
+	f.String("crowdsec-registration-token-file", "", "File containing the CrowdSec auto-registration token, re-read on change")
+	f.String("crowdsec-machine-name", "", "Machine name for auto-registration when no login is set (defaults to hostname)")
+	f.String("crowdsec-state-file", "", "File persisting a generated password for auto-registration when no password is set")
 	f.Bool("crowdsec-deregister-on-exit", false, "Deregister machine on application exit")
+	f.String("crowdsec-api-key", "", "CrowdSec bouncer API key (reads /v1/decisions instead of alerts)")
+	f.String("crowdsec-cert-file", "", "Client certificate for LAPI TLS authentication")
+	f.String("crowdsec-key-file", "", "Client private key for LAPI TLS authentication")
+	f.String("crowdsec-ca-file", "", "CA bundle used to verify the LAPI server certificate")
+	f.String("crowdsec-tls-server-name", "", "Server name used to verify the LAPI certificate (defaults to the URL host)")
+	f.String("crowdsec-tls-min-version", "1.2", "Minimum TLS version for LAPI connections (1.0, 1.1, 1.2, 1.3)")
+	f.Bool("crowdsec-tls-insecure-skip-verify", false, "Skip LAPI certificate verification (insecure, for labs only)")
+	f.String("crowdsec-proxy-url", "", "HTTP proxy for LAPI requests (defaults to HTTP_PROXY/HTTPS_PROXY)")
+	f.String("crowdsec-no-proxy", "", "Comma-separated hosts, domains, IPs and CIDRs that bypass the proxy")
+	f.Duration("crowdsec-token-refresh-margin", 5*time.Minute, "Renew the LAPI token this long before it expires (0 disables background refresh)")
+	f.StringSlice("alerts-origins", nil, "Decision origins to query alerts for, such as crowdsec, cscli, console, appsec, CAPI or lists, or * for any (defaults to crowdsec)")
+	f.String("alerts-scenario", "", "Only query alerts for this scenario")
+	f.String("alerts-scope", "", "Only query alerts whose source has this scope (e.g. Ip, Range, Country)")
+	f.String("alerts-value", "", "Only query alerts whose source has this value")
+	f.String("alerts-range", "", "Only query alerts whose source IP is within this CIDR range")
+	f.String("alerts-decision-type", "", "Only query alerts carrying decisions of this type (e.g. ban, captcha)")
+	f.Duration("alerts-since", 0, "Only query alerts created within this long before now (0 disables)")
+	f.Duration("alerts-until", 0, "Only query alerts created more than this long before now (0 disables)")
+	f.Bool("alerts-has-active-decision", false, "Only query alerts with an active decision")
+	f.Bool("alerts-include-capi", false, "Include alerts carrying CAPI and blocklist decisions")
+	f.Bool("alerts-simulated", false, "Include alerts from scenarios in simulation mode")
+	f.Int("crowdsec-page-size", config.DefaultPageSize, "Number of alerts requested per LAPI call")
+	f.Int("crowdsec-max-results", 0, "Maximum alerts or decisions read per scrape (0 reads everything)")
+	f.Int("crowdsec-retries", 5, "Number of times a LAPI request failing with a network error, 429 or 5xx is retried")
+	f.Duration("crowdsec-retry-backoff", 500*time.Millisecond, "Delay before the first retry, doubled for each retry after with jitter (Retry-After takes precedence)")
+	f.Duration("crowdsec-request-timeout", 30*time.Second, "Timeout for LAPI requests made outside a scrape, and for scrapes that send no timeout (0 disables)")
+	f.Bool("crowdsec-stream", false, "Keep decisions in sync through /v1/decisions/stream instead of reading them on every scrape (requires --crowdsec-api-key)")
+	f.Duration("crowdsec-stream-interval", config.DefaultStreamInterval, "How often the decision stream is polled")
 	f.String("listen-address", ":9090", "Address to listen on for web interface and metrics")
 	f.String("metrics-path", "/metrics", "Path under which to expose metrics")
+	f.Duration("scrape-timeout-offset", 500*time.Millisecond, "Subtracted from the Prometheus scrape timeout to leave time to send the response")
 	f.String("instance-name", "crowdsec", "Instance name to use in metrics labels")
+	f.Duration("poll-interval", 0, "Refresh a snapshot from LAPI in the background at this interval and serve scrapes from it (0 queries LAPI on every scrape)")
+	f.Bool("events", false, "Export event metadata from alerts as cs_lapi_alert_event_meta")
+	f.StringSlice("event-meta-keys", config.DefaultEventMetaKeys, "Event meta keys exported when --events is set")
+	f.StringSlice("decision-labels", config.DefaultDecisionLabels, "Labels of cs_lapi_decision besides instance, one of: "+strings.Join(config.DecisionLabels, ", "))
+	f.Bool("alert-metrics", false, "Export alerts as cs_lapi_alert, including those without decisions (queries every origin unless --alerts-origins is set)")
+	f.Bool("aggregate-active", false, "Export decision counts by scenario, type and origin as cs_lapi_decisions_active")
+	f.Bool("aggregate-by-country", false, "Export decision counts by country as cs_lapi_decisions_active_by_country")
+	f.Bool("aggregate-by-asn", false, "Export decision counts by AS as cs_lapi_decisions_active_by_asn")
 	f.String("log-level", "info", "Log level (debug, info, warn, error)")
 
 	binds := map[string]string{
-		"crowdsec.url":                "crowdsec-url",
-		"crowdsec.login":              "crowdsec-login",
-		"crowdsec.password":           "crowdsec-password",
-		"crowdsec.registration_token": "crowdsec-registration-token",
-		"crowdsec.machine_name":       "crowdsec-machine-name",
-		"crowdsec.deregister_on_exit": "crowdsec-deregister-on-exit",
-		"server.listen_address":       "listen-address",
-		"server.metrics_path":         "metrics-path",
-		"exporter.instance_name":      "instance-name",
-		"log_level":                   "log-level",
+		"crowdsec.url":                        "crowdsec-url",
+		"crowdsec.credentials_file":           "crowdsec-credentials-file",
+		"crowdsec.login":                      "crowdsec-login",
+		"crowdsec.password":                   "crowdsec-password",
+		"crowdsec.password_file":              "crowdsec-password-file",
+		"crowdsec.registration_token":         "crowdsec-registration-token",
+		"crowdsec.registration_token_file":    "crowdsec-registration-token-file",
+		"crowdsec.machine_name":               "crowdsec-machine-name",
+		"crowdsec.state_file":                 "crowdsec-state-file",
+		"crowdsec.deregister_on_exit":         "crowdsec-deregister-on-exit",
+		"crowdsec.api_key":                    "crowdsec-api-key",
+		"crowdsec.tls.cert_file":              "crowdsec-cert-file",
+		"crowdsec.tls.key_file":               "crowdsec-key-file",
+		"crowdsec.tls.ca_file":                "crowdsec-ca-file",
+		"crowdsec.tls.server_name":            "crowdsec-tls-server-name",
+		"crowdsec.tls.min_version":            "crowdsec-tls-min-version",
+		"crowdsec.tls.insecure_skip_verify":   "crowdsec-tls-insecure-skip-verify",
+		"crowdsec.proxy.url":                  "crowdsec-proxy-url",
+		"crowdsec.proxy.no_proxy":             "crowdsec-no-proxy",
+		"crowdsec.token_refresh_margin":       "crowdsec-token-refresh-margin",
+		"crowdsec.alerts.origins":             "alerts-origins",
+		"crowdsec.alerts.scenario":            "alerts-scenario",
+		"crowdsec.alerts.scope":               "alerts-scope",
+		"crowdsec.alerts.value":               "alerts-value",
+		"crowdsec.alerts.range":               "alerts-range",
+		"crowdsec.alerts.decision_type":       "alerts-decision-type",
+		"crowdsec.alerts.since":               "alerts-since",
+		"crowdsec.alerts.until":               "alerts-until",
+		"crowdsec.alerts.has_active_decision": "alerts-has-active-decision",
+		"crowdsec.alerts.include_capi":        "alerts-include-capi",
+		"crowdsec.alerts.simulated":           "alerts-simulated",
+		"crowdsec.page_size":                  "crowdsec-page-size",
+		"crowdsec.max_results":                "crowdsec-max-results",
+		"crowdsec.retries":                    "crowdsec-retries",
+		"crowdsec.retry_backoff":              "crowdsec-retry-backoff",
+		"crowdsec.request_timeout":            "crowdsec-request-timeout",
+		"crowdsec.stream.enabled":             "crowdsec-stream",
+		"crowdsec.stream.interval":            "crowdsec-stream-interval",
+		"server.listen_address":               "listen-address",
+		"server.metrics_path":                 "metrics-path",
+		"server.scrape_timeout_offset":        "scrape-timeout-offset",
+		"exporter.instance_name":              "instance-name",
+		"exporter.poll_interval":              "poll-interval",
+		"exporter.events.enabled":             "events",
+		"exporter.events.meta_keys":           "event-meta-keys",
+		"exporter.decision_labels":            "decision-labels",
+		"exporter.alert_metrics":              "alert-metrics",
+		"exporter.aggregates.active":          "aggregate-active",
+		"exporter.aggregates.by_country":      "aggregate-by-country",
+		"exporter.aggregates.by_asn":          "aggregate-by-asn",
+		"log_level":                           "log-level",
 	}
 	for key, flag := range binds {
 		if err := viper.BindPFlag(key, f.Lookup(flag)); err != nil {
@@ -78,7 +184,7 @@ func newRootCmd() *cobra.Command {
 		}
 	}
 
-	cmd.AddCommand(newVersionCmd())
+	cmd.AddCommand(newVersionCmd(), newRegisterCmd(), newDeregisterCmd(), newWhoamiCmd())
 	return cmd
 }
 
@@ -94,24 +200,59 @@ func newVersionCmd() *cobra.Command {
 	}
 }
 
-func runExporter() error {
+// loadConfig decodes and validates the configuration and installs the logger
+func loadConfig() (*config.Config, *slog.Logger, error) {
+	if err := applyCredentialsFile(); err != nil {
+		return nil, nil, &exitError{exitConfig, err}
+	}
+
 	cfg := &config.Config{}
 	if err := viper.Unmarshal(cfg); err != nil {
-		return fmt.Errorf("decode config: %w", err)
+		return nil, nil, &exitError{exitConfig, fmt.Errorf("decode config: %w", err)}
 	}
 	if err := cfg.Validate(); err != nil {
-		return fmt.Errorf("config validation: %w", err)
+		return nil, nil, &exitError{exitConfig, fmt.Errorf("config validation: %w", err)}
 	}
 
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: cfg.GetLogLevel()}))
 	slog.SetDefault(logger)
+	return cfg, logger, nil
+}
+
+// newClient loads the configuration and creates a LAPI client for it
+func newClient() (*config.Config, *crowdsec.Client, error) {
+	cfg, logger, err := loadConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, err := crowdsec.NewClient(cfg, crowdsec.WithLogger(logger))
+	if err != nil {
+		return nil, nil, &exitError{exitConfig, fmt.Errorf("create crowdsec client: %w", err)}
+	}
+	return cfg, client, nil
+}
 
-	if _, err := exporter.New(cfg); err != nil {
+func runExporter() error {
+	cfg, client, err := newClient()
+	if err != nil {
+		return err
+	}
+	exp, err := exporter.New(cfg, client)
+	if err != nil {
 		return fmt.Errorf("create exporter: %w", err)
 	}
+	prometheus.MustRegister(exporter.NewBuildInfo(version, commit, date))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.RunTokenRefresher(ctx)
+	go client.WatchSecrets(ctx)
+	go client.RunDecisionStream(ctx)
+	go exp.RunPoller(ctx)
 
 	mux := http.NewServeMux()
-	mux.Handle(cfg.Server.MetricsPath, promhttp.Handler())
+	mux.Handle(cfg.Server.MetricsPath, exp.Handler())
 	mux.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
 		fmt.Fprintf(w, indexHTML, cfg.Server.MetricsPath)
@@ -135,14 +276,17 @@ func runExporter() error {
 
 	<-stop
 	slog.Info("shutdown initiated")
+	cancel()
 
-	if err := crowdsec.DeregisterMachine(); err != nil {
+	deregisterCtx, deregisterCancel := client.RequestContext(context.Background())
+	defer deregisterCancel()
+	if err := client.DeregisterMachine(deregisterCtx); err != nil {
 		slog.Warn("deregister failed", "error", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := server.Shutdown(ctx); err != nil {
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
 		slog.Error("forced shutdown", "error", err)
 		return err
 	}
@@ -151,6 +295,24 @@ func runExporter() error {
 	return nil
 }
 
+// applyCredentialsFile loads local_api_credentials.yaml values as defaults,
+// so explicit flags and environment variables still take precedence
+func applyCredentialsFile() error {
+	path := viper.GetString("crowdsec.credentials_file")
+	if path == "" {
+		return nil
+	}
+
+	creds, err := config.LoadCredentialsFile(path)
+	if err != nil {
+		return err
+	}
+	for key, value := range creds.Settings() {
+		viper.SetDefault(key, value)
+	}
+	return nil
+}
+
 const indexHTML = `<!doctype html>
 <html>
 <head><meta charset="utf-8"><title>CrowdSec Exporter</title></head>
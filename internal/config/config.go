@@ -1,9 +1,14 @@
 package config
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log/slog"
+	"net"
+	"net/url"
+	"slices"
 	"strings"
+	"time"
 )
 
 // Config represents the application configuration
@@ -20,38 +25,241 @@ type CrowdSecConfig struct {
 	Login             string `mapstructure:"login"`
 	Password          string `mapstructure:"password"`
 	RegistrationToken string `mapstructure:"registration_token"`
-	MachineName       string `mapstructure:"machine_name"`
-	DeregisterOnExit  bool   `mapstructure:"deregister_on_exit"`
+
+	// Secret files are read at startup and re-read when they change
+	PasswordFile          string `mapstructure:"password_file"`
+	RegistrationTokenFile string `mapstructure:"registration_token_file"`
+
+	// CredentialsFile points at a local_api_credentials.yaml shared with the agent
+	CredentialsFile string `mapstructure:"credentials_file"`
+
+	// MachineName is registered when Login is empty, defaulting to the hostname
+	MachineName string `mapstructure:"machine_name"`
+	// StateFile persists a generated password for auto-registered machines
+	StateFile        string `mapstructure:"state_file"`
+	DeregisterOnExit bool   `mapstructure:"deregister_on_exit"`
+
+	APIKey string       `mapstructure:"api_key"`
+	TLS    TLSConfig    `mapstructure:"tls"`
+	Proxy  ProxyConfig  `mapstructure:"proxy"`
+	Alerts AlertsConfig `mapstructure:"alerts"`
+	Stream StreamConfig `mapstructure:"stream"`
+
+	// TokenRefreshMargin renews the JWT this long before expiry, 0 disables background refresh
+	TokenRefreshMargin time.Duration `mapstructure:"token_refresh_margin"`
+
+	// PageSize is the number of alerts requested per LAPI call
+	PageSize int `mapstructure:"page_size"`
+	// MaxResults caps the alerts or decisions read per scrape, 0 reads everything
+	MaxResults int `mapstructure:"max_results"`
+	// Retries is how many times a failed LAPI request is retried
+	Retries int `mapstructure:"retries"`
+	// RetryBackoff is the delay before the first retry, doubled for each one after
+	RetryBackoff time.Duration `mapstructure:"retry_backoff"`
+	// RequestTimeout bounds LAPI work done outside a scrape, 0 disables it
+	RequestTimeout time.Duration `mapstructure:"request_timeout"`
+}
+
+// DefaultPageSize is used when no page size is configured
+const DefaultPageSize = 1000
+
+// TLSConfig contains TLS settings for LAPI connections
+type TLSConfig struct {
+	CertFile   string `mapstructure:"cert_file"`
+	KeyFile    string `mapstructure:"key_file"`
+	CAFile     string `mapstructure:"ca_file"`
+	ServerName string `mapstructure:"server_name"`
+	MinVersion string `mapstructure:"min_version"`
+	// InsecureSkipVerify disables server certificate verification, for labs only
+	InsecureSkipVerify bool `mapstructure:"insecure_skip_verify"`
+}
+
+// ProxyConfig contains HTTP proxy settings for LAPI connections.
+// Without a URL the HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables apply.
+type ProxyConfig struct {
+	URL string `mapstructure:"url"`
+	// NoProxy is a comma-separated list of hosts, domains, IPs and CIDRs reached directly
+	NoProxy string `mapstructure:"no_proxy"`
+}
+
+// AlertsConfig contains the filters applied when querying /v1/alerts
+type AlertsConfig struct {
+	// Origins are queried one at a time since LAPI only filters on a single origin
+	Origins      []string `mapstructure:"origins"`
+	Scenario     string   `mapstructure:"scenario"`
+	Scope        string   `mapstructure:"scope"`
+	Value        string   `mapstructure:"value"`
+	Range        string   `mapstructure:"range"`
+	DecisionType string   `mapstructure:"decision_type"`
+
+	// Since and Until select alerts created within that long before now
+	Since time.Duration `mapstructure:"since"`
+	Until time.Duration `mapstructure:"until"`
+
+	HasActiveDecision bool `mapstructure:"has_active_decision"`
+	// IncludeCAPI is required to see alerts carrying CAPI or blocklist decisions
+	IncludeCAPI bool `mapstructure:"include_capi"`
+	Simulated   bool `mapstructure:"simulated"`
+}
+
+// StreamConfig controls the /v1/decisions/stream consumer used with bouncer API keys
+type StreamConfig struct {
+	Enabled  bool          `mapstructure:"enabled"`
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+// DefaultStreamInterval is used when no stream interval is configured
+const DefaultStreamInterval = 10 * time.Second
+
+// DefaultAlertOrigins are queried when no origins are configured
+var DefaultAlertOrigins = []string{"crowdsec"}
+
+// AnyOrigin as the only origin queries alerts without an origin filter, which also
+// returns alerts that carry no decision
+const AnyOrigin = "*"
+
+// tlsVersions maps accepted min_version values to crypto/tls constants
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// MinTLSVersion returns the configured minimum TLS version, defaulting to TLS 1.2
+func (t TLSConfig) MinTLSVersion() uint16 {
+	if v, ok := tlsVersions[t.MinVersion]; ok {
+		return v
+	}
+	return tls.VersionTLS12
+}
+
+// Authentication modes supported against LAPI
+const (
+	AuthModePassword = "password"
+	AuthModeTLS      = "tls"
+	AuthModeAPIKey   = "apikey"
+)
+
+// AuthMode returns the authentication mode implied by the configuration.
+// Validate rejects setups where more than one mode is configured.
+func (c *CrowdSecConfig) AuthMode() string {
+	if c.APIKey != "" {
+		return AuthModeAPIKey
+	}
+	if c.TLS.CertFile != "" || c.TLS.KeyFile != "" {
+		return AuthModeTLS
+	}
+	return AuthModePassword
 }
 
 // ServerConfig contains HTTP server configuration
 type ServerConfig struct {
 	ListenAddress string `mapstructure:"listen_address"`
 	MetricsPath   string `mapstructure:"metrics_path"`
+	// ScrapeTimeoutOffset is subtracted from the Prometheus scrape timeout to leave time to reply
+	ScrapeTimeoutOffset time.Duration `mapstructure:"scrape_timeout_offset"`
 }
 
 // ExporterConfig contains exporter-specific configuration
 type ExporterConfig struct {
-	InstanceName string `mapstructure:"instance_name"`
+	InstanceName string           `mapstructure:"instance_name"`
+	Events       EventsConfig     `mapstructure:"events"`
+	Aggregates   AggregatesConfig `mapstructure:"aggregates"`
+	// AlertMetrics exports every alert read, including those that led to no decision.
+	// Without configured origins, alerts are then queried without an origin filter.
+	AlertMetrics bool `mapstructure:"alert_metrics"`
+	// DecisionLabels are the labels of cs_lapi_decision besides instance
+	DecisionLabels []string `mapstructure:"decision_labels"`
+	// PollInterval refreshes a snapshot in the background that scrapes are served from, 0 queries LAPI on every scrape
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+}
+
+// EventsConfig controls export of the event metadata attached to alerts
+type EventsConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// MetaKeys selects which event meta keys become label values
+	MetaKeys []string `mapstructure:"meta_keys"`
+}
+
+// AggregatesConfig selects the decision counts exported alongside cs_lapi_decision
+type AggregatesConfig struct {
+	// Active exports cs_lapi_decisions_active{scenario,type,origin}
+	Active bool `mapstructure:"active"`
+	// ByCountry exports cs_lapi_decisions_active_by_country{country}
+	ByCountry bool `mapstructure:"by_country"`
+	// ByASN exports cs_lapi_decisions_active_by_asn{asnumber,asname}
+	ByASN bool `mapstructure:"by_asn"`
 }
 
+// DefaultDecisionLabels are the cs_lapi_decision labels used when none are configured
+var DefaultDecisionLabels = []string{"id", "country", "asname", "asnumber", "latitude", "longitude", "iprange", "scenario", "type", "duration", "scope", "ip"}
+
+// DecisionLabels lists every label cs_lapi_decision can carry besides instance
+var DecisionLabels = append(slices.Clone(DefaultDecisionLabels), "origin", "machine_id", "until", "simulated")
+
+// DefaultEventMetaKeys are the event meta keys exported when none are configured
+var DefaultEventMetaKeys = []string{"service", "log_type", "target_fqdn", "http_path", "http_user_agent"}
+
 // Validate validates the configuration
 func (c *Config) Validate() error {
 	var errors []string
 
 	if c.CrowdSec.URL == "" {
 		errors = append(errors, "crowdsec.url is required")
+	} else {
+		errors = append(errors, c.CrowdSec.validateURLs()...)
 	}
 
-	// Login and Password are now required
-	if c.CrowdSec.Login == "" {
-		errors = append(errors, "crowdsec.login is required")
+	errors = append(errors, c.CrowdSec.validateAuth()...)
+
+	if _, ok := tlsVersions[c.CrowdSec.TLS.MinVersion]; c.CrowdSec.TLS.MinVersion != "" && !ok {
+		errors = append(errors, "crowdsec.tls.min_version must be one of: 1.0, 1.1, 1.2, 1.3")
 	}
-	if c.CrowdSec.Password == "" {
-		errors = append(errors, "crowdsec.password is required")
+
+	// LAPI's origin filter only matches alerts holding a decision from that origin,
+	// so alerts that led to no decision are only returned without one
+	if c.Exporter.AlertMetrics && c.CrowdSec.AuthMode() != AuthModeAPIKey && len(c.CrowdSec.Alerts.Origins) == 0 {
+		c.CrowdSec.Alerts.Origins = []string{AnyOrigin}
 	}
+	errors = append(errors, c.CrowdSec.validateAlerts()...)
 
-	// Registration token is optional for auto-registration
+	if c.CrowdSec.TokenRefreshMargin < 0 {
+		errors = append(errors, "crowdsec.token_refresh_margin must not be negative")
+	}
+
+	switch {
+	case c.CrowdSec.PageSize == 0:
+		c.CrowdSec.PageSize = DefaultPageSize
+	case c.CrowdSec.PageSize < 0:
+		errors = append(errors, "crowdsec.page_size must be positive")
+	}
+	if c.CrowdSec.Stream.Enabled {
+		if c.CrowdSec.AuthMode() != AuthModeAPIKey {
+			errors = append(errors, "crowdsec.stream.enabled requires crowdsec.api_key, LAPI only streams decisions to bouncers")
+		}
+		switch {
+		case c.CrowdSec.Stream.Interval == 0:
+			c.CrowdSec.Stream.Interval = DefaultStreamInterval
+		case c.CrowdSec.Stream.Interval < 0:
+			errors = append(errors, "crowdsec.stream.interval must be positive")
+		}
+	}
+	if c.CrowdSec.MaxResults < 0 {
+		errors = append(errors, "crowdsec.max_results must not be negative")
+	}
+	if c.CrowdSec.Retries < 0 {
+		errors = append(errors, "crowdsec.retries must not be negative")
+	}
+	if c.CrowdSec.RetryBackoff < 0 {
+		errors = append(errors, "crowdsec.retry_backoff must not be negative")
+	}
+	if c.CrowdSec.RequestTimeout < 0 {
+		errors = append(errors, "crowdsec.request_timeout must not be negative")
+	}
+	if c.Server.ScrapeTimeoutOffset < 0 {
+		errors = append(errors, "server.scrape_timeout_offset must not be negative")
+	}
 
 	if c.Server.ListenAddress == "" {
 		c.Server.ListenAddress = ":9999"
@@ -65,6 +273,35 @@ func (c *Config) Validate() error {
 		c.Exporter.InstanceName = "crowdsec"
 	}
 
+	if c.Exporter.PollInterval < 0 {
+		errors = append(errors, "exporter.poll_interval must not be negative")
+	}
+
+	if len(c.Exporter.DecisionLabels) == 0 {
+		c.Exporter.DecisionLabels = DefaultDecisionLabels
+	}
+	for i, label := range c.Exporter.DecisionLabels {
+		switch {
+		case !slices.Contains(DecisionLabels, label):
+			errors = append(errors, fmt.Sprintf("exporter.decision_labels: unknown label %q, must be one of: %s", label, strings.Join(DecisionLabels, ", ")))
+		case slices.Contains(c.Exporter.DecisionLabels[:i], label):
+			errors = append(errors, fmt.Sprintf("exporter.decision_labels: label %q is listed twice", label))
+		}
+	}
+
+	if c.Exporter.AlertMetrics && c.CrowdSec.AuthMode() == AuthModeAPIKey {
+		errors = append(errors, "exporter.alert_metrics requires alerts, which bouncer API keys cannot read")
+	}
+
+	if c.Exporter.Events.Enabled {
+		if len(c.Exporter.Events.MetaKeys) == 0 {
+			c.Exporter.Events.MetaKeys = DefaultEventMetaKeys
+		}
+		if c.CrowdSec.AuthMode() == AuthModeAPIKey {
+			errors = append(errors, "exporter.events.enabled requires alerts, which bouncer API keys cannot read")
+		}
+	}
+
 	// Set default log level if empty
 	if c.LogLevel == "" {
 		c.LogLevel = "info"
@@ -90,6 +327,166 @@ func (c *Config) Validate() error {
 	return nil
 }
 
+// validateURLs checks the LAPI and proxy addresses
+func (c *CrowdSecConfig) validateURLs() []string {
+	var errors []string
+
+	u, err := url.Parse(c.URL)
+	switch {
+	case err != nil:
+		errors = append(errors, fmt.Sprintf("crowdsec.url is invalid: %v", err))
+	case u.Scheme == "unix":
+		if u.Path == "" {
+			errors = append(errors, "crowdsec.url must include the socket path, e.g. unix:///run/crowdsec/lapi.sock")
+		}
+		if c.Proxy.URL != "" {
+			errors = append(errors, "crowdsec.proxy.url cannot be used with a unix socket crowdsec.url")
+		}
+	case u.Scheme != "http" && u.Scheme != "https":
+		errors = append(errors, "crowdsec.url scheme must be http, https or unix")
+	}
+
+	if c.Proxy.URL != "" {
+		p, err := url.Parse(c.Proxy.URL)
+		if err != nil || p.Host == "" {
+			errors = append(errors, "crowdsec.proxy.url must be an absolute URL, e.g. http://proxy:3128")
+		} else if p.Scheme != "http" && p.Scheme != "https" && p.Scheme != "socks5" {
+			errors = append(errors, "crowdsec.proxy.url scheme must be http, https or socks5")
+		}
+	}
+
+	return errors
+}
+
+// validateAuth ensures exactly one authentication mode is configured
+func (c *CrowdSecConfig) validateAuth() []string {
+	var errors []string
+
+	autoRegister := c.RegistrationToken != "" || c.RegistrationTokenFile != ""
+
+	var modes []string
+	if c.Login != "" || c.Password != "" || c.PasswordFile != "" {
+		modes = append(modes, "crowdsec.login/crowdsec.password")
+	}
+	if c.TLS.CertFile != "" || c.TLS.KeyFile != "" {
+		modes = append(modes, "crowdsec.tls.cert_file/crowdsec.tls.key_file")
+	}
+	if c.APIKey != "" {
+		modes = append(modes, "crowdsec.api_key")
+	}
+
+	// A registration token alone is enough, the identity is derived from machine_name
+	if len(modes) == 0 && autoRegister {
+		modes = append(modes, "crowdsec.registration_token")
+	}
+
+	switch {
+	case len(modes) == 0:
+		errors = append(errors, "one of crowdsec.login/crowdsec.password, crowdsec.tls.cert_file/crowdsec.tls.key_file or crowdsec.api_key is required")
+		return errors
+	case len(modes) > 1:
+		errors = append(errors, fmt.Sprintf("%s are mutually exclusive", strings.Join(modes, " and ")))
+		return errors
+	}
+
+	switch c.AuthMode() {
+	case AuthModeTLS:
+		if c.TLS.CertFile == "" {
+			errors = append(errors, "crowdsec.tls.cert_file is required when crowdsec.tls.key_file is set")
+		}
+		if c.TLS.KeyFile == "" {
+			errors = append(errors, "crowdsec.tls.key_file is required when crowdsec.tls.cert_file is set")
+		}
+	case AuthModePassword:
+		if c.Login == "" && !autoRegister {
+			errors = append(errors, "crowdsec.login is required unless auto-registering with crowdsec.registration_token")
+		}
+		if c.Password == "" && c.PasswordFile == "" && !(autoRegister && c.StateFile != "") {
+			errors = append(errors, "crowdsec.password or crowdsec.password_file is required unless auto-registering with crowdsec.state_file")
+		}
+		if c.Password != "" && c.PasswordFile != "" {
+			errors = append(errors, "crowdsec.password and crowdsec.password_file are mutually exclusive")
+		}
+	}
+
+	// Only watchers authenticating with a password can auto-register
+	if c.RegistrationToken != "" && c.RegistrationTokenFile != "" {
+		errors = append(errors, "crowdsec.registration_token and crowdsec.registration_token_file are mutually exclusive")
+	}
+	if c.StateFile != "" && !autoRegister {
+		errors = append(errors, "crowdsec.state_file requires crowdsec.registration_token")
+	}
+	// machine_name only names a machine registered without an explicit login
+	switch {
+	case c.MachineName != "" && !autoRegister:
+		errors = append(errors, "crowdsec.machine_name requires crowdsec.registration_token")
+	case c.MachineName != "" && c.Login != "":
+		errors = append(errors, "crowdsec.machine_name and crowdsec.login are mutually exclusive")
+	}
+	if autoRegister && c.AuthMode() != AuthModePassword {
+		errors = append(errors, fmt.Sprintf("crowdsec.registration_token cannot be used with %s authentication", c.AuthMode()))
+	}
+
+	return errors
+}
+
+// validateAlerts checks the alert query filters
+func (c *CrowdSecConfig) validateAlerts() []string {
+	var errors []string
+	a := &c.Alerts
+
+	// Bouncer API keys read /v1/decisions, which none of these filters apply to
+	if c.AuthMode() == AuthModeAPIKey {
+		if len(a.Origins) > 0 || a.Scenario != "" || a.Scope != "" || a.Value != "" || a.Range != "" ||
+			a.DecisionType != "" || a.Since != 0 || a.Until != 0 || a.HasActiveDecision || a.IncludeCAPI || a.Simulated {
+			errors = append(errors, "crowdsec.alerts filters cannot be used with bouncer API keys")
+		}
+		return errors
+	}
+
+	if len(a.Origins) == 0 {
+		a.Origins = DefaultAlertOrigins
+	}
+	// Origins are not checked against a list: newer LAPIs add some, such as appsec
+	for _, origin := range a.Origins {
+		switch {
+		case origin == AnyOrigin && len(a.Origins) > 1:
+			errors = append(errors, fmt.Sprintf("crowdsec.alerts.origins: %q cannot be combined with other origins", AnyOrigin))
+		case origin == "":
+			errors = append(errors, "crowdsec.alerts.origins: origins must not be empty")
+		case (origin == "CAPI" || origin == "lists") && !a.IncludeCAPI:
+			errors = append(errors, fmt.Sprintf("crowdsec.alerts.origins: origin %q requires crowdsec.alerts.include_capi", origin))
+		}
+	}
+
+	if a.Range != "" {
+		if _, _, err := net.ParseCIDR(a.Range); err != nil {
+			errors = append(errors, fmt.Sprintf("crowdsec.alerts.range must be a CIDR range: %v", err))
+		}
+	}
+
+	if a.Value != "" {
+		switch strings.ToLower(a.Scope) {
+		case "ip":
+			if net.ParseIP(a.Value) == nil {
+				errors = append(errors, fmt.Sprintf("crowdsec.alerts.value %q is not an IP address", a.Value))
+			}
+		case "range":
+			if _, _, err := net.ParseCIDR(a.Value); err != nil {
+				errors = append(errors, fmt.Sprintf("crowdsec.alerts.value %q is not a CIDR range", a.Value))
+			}
+		}
+	}
+
+	if a.Since < 0 || a.Until < 0 {
+		errors = append(errors, "crowdsec.alerts.since and crowdsec.alerts.until must not be negative")
+	} else if a.Since != 0 && a.Until != 0 && a.Since <= a.Until {
+		errors = append(errors, "crowdsec.alerts.since must be longer than crowdsec.alerts.until")
+	}
+
+	return errors
+}
+
 // GetLogLevel returns the slog.Level for the configured log level
 func (c *Config) GetLogLevel() slog.Level {
 	switch strings.ToLower(c.LogLevel) {
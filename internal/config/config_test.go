@@ -0,0 +1,297 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestValidateAuthModes ensures exactly one authentication mode is accepted.
+func TestValidateAuthModes(t *testing.T) {
+	tests := []struct {
+		name    string
+		crowd   CrowdSecConfig
+		mode    string
+		wantErr string
+	}{
+		{
+			name:  "password",
+			crowd: CrowdSecConfig{Login: "machine", Password: "secret"},
+			mode:  AuthModePassword,
+		},
+		{
+			name:  "client certificate",
+			crowd: CrowdSecConfig{TLS: TLSConfig{CertFile: "agent.pem", KeyFile: "agent-key.pem"}},
+			mode:  AuthModeTLS,
+		},
+		{
+			name:  "bouncer api key",
+			crowd: CrowdSecConfig{APIKey: "key"},
+			mode:  AuthModeAPIKey,
+		},
+		{
+			name:    "api key and password",
+			crowd:   CrowdSecConfig{APIKey: "key", Login: "machine", Password: "secret"},
+			wantErr: "mutually exclusive",
+		},
+		{
+			name:  "password file",
+			crowd: CrowdSecConfig{Login: "machine", PasswordFile: "/run/secrets/password"},
+			mode:  AuthModePassword,
+		},
+		{
+			name:    "password and password file",
+			crowd:   CrowdSecConfig{Login: "machine", Password: "secret", PasswordFile: "/run/secrets/password"},
+			wantErr: "crowdsec.password and crowdsec.password_file are mutually exclusive",
+		},
+		{
+			name:  "auto-registration with generated identity",
+			crowd: CrowdSecConfig{RegistrationToken: "token", MachineName: "exporter", StateFile: "/var/lib/crowdsec-exporter/state.json"},
+			mode:  AuthModePassword,
+		},
+		{
+			name:    "auto-registration without password or state file",
+			crowd:   CrowdSecConfig{RegistrationToken: "token"},
+			wantErr: "crowdsec.password or crowdsec.password_file is required",
+		},
+		{
+			name:    "machine name with login",
+			crowd:   CrowdSecConfig{RegistrationToken: "token", Login: "machine", Password: "secret", MachineName: "exporter"},
+			wantErr: "crowdsec.machine_name and crowdsec.login are mutually exclusive",
+		},
+		{
+			name:    "machine name without registration token",
+			crowd:   CrowdSecConfig{Login: "machine", Password: "secret", MachineName: "exporter"},
+			wantErr: "crowdsec.machine_name requires crowdsec.registration_token",
+		},
+		{
+			name:    "state file without registration token",
+			crowd:   CrowdSecConfig{Login: "machine", Password: "secret", StateFile: "/var/lib/crowdsec-exporter/state.json"},
+			wantErr: "crowdsec.state_file requires crowdsec.registration_token",
+		},
+		{
+			name:    "none",
+			crowd:   CrowdSecConfig{},
+			wantErr: "one of crowdsec.login/crowdsec.password",
+		},
+		{
+			name: "password and certificate",
+			crowd: CrowdSecConfig{
+				Login:    "machine",
+				Password: "secret",
+				TLS:      TLSConfig{CertFile: "agent.pem", KeyFile: "agent-key.pem"},
+			},
+			wantErr: "mutually exclusive",
+		},
+		{
+			name:    "certificate without key",
+			crowd:   CrowdSecConfig{TLS: TLSConfig{CertFile: "agent.pem"}},
+			wantErr: "crowdsec.tls.key_file is required",
+		},
+		{
+			name: "certificate with registration token",
+			crowd: CrowdSecConfig{
+				RegistrationToken: "token",
+				TLS:               TLSConfig{CertFile: "agent.pem", KeyFile: "agent-key.pem"},
+			},
+			wantErr: "crowdsec.registration_token cannot be used with tls authentication",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.crowd.URL = "http://localhost:8080"
+			cfg := &Config{CrowdSec: tt.crowd}
+
+			err := cfg.Validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := cfg.CrowdSec.AuthMode(); got != tt.mode {
+				t.Fatalf("expected auth mode %q, got %q", tt.mode, got)
+			}
+		})
+	}
+}
+
+// TestValidateAlertFilters ensures alert query filters are checked and origins defaulted.
+func TestValidateAlertFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		alerts  AlertsConfig
+		apiKey  string
+		wantErr string
+	}{
+		{
+			name:   "defaults",
+			alerts: AlertsConfig{},
+		},
+		{
+			name:   "multiple origins",
+			alerts: AlertsConfig{Origins: []string{"crowdsec", "cscli", "CAPI"}, IncludeCAPI: true},
+		},
+		{
+			name:   "newer origin",
+			alerts: AlertsConfig{Origins: []string{"crowdsec", "appsec"}},
+		},
+		{
+			name:   "any origin",
+			alerts: AlertsConfig{Origins: []string{AnyOrigin}},
+		},
+		{
+			name:    "any origin with others",
+			alerts:  AlertsConfig{Origins: []string{AnyOrigin, "crowdsec"}},
+			wantErr: "cannot be combined with other origins",
+		},
+		{
+			name:    "CAPI without include_capi",
+			alerts:  AlertsConfig{Origins: []string{"CAPI"}},
+			wantErr: "requires crowdsec.alerts.include_capi",
+		},
+		{
+			name:    "invalid range",
+			alerts:  AlertsConfig{Range: "10.0.0.1"},
+			wantErr: "crowdsec.alerts.range must be a CIDR range",
+		},
+		{
+			name:    "ip scope with invalid value",
+			alerts:  AlertsConfig{Scope: "Ip", Value: "example.com"},
+			wantErr: "is not an IP address",
+		},
+		{
+			name:    "since not before until",
+			alerts:  AlertsConfig{Since: time.Hour, Until: 2 * time.Hour},
+			wantErr: "crowdsec.alerts.since must be longer than crowdsec.alerts.until",
+		},
+		{
+			name:    "filters with api key",
+			alerts:  AlertsConfig{Scenario: "crowdsecurity/ssh-bf"},
+			apiKey:  "key",
+			wantErr: "cannot be used with bouncer API keys",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crowd := CrowdSecConfig{URL: "http://localhost:8080", APIKey: tt.apiKey, Alerts: tt.alerts}
+			if tt.apiKey == "" {
+				crowd.Login, crowd.Password = "machine", "secret"
+			}
+			cfg := &Config{CrowdSec: crowd}
+
+			err := cfg.Validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(cfg.CrowdSec.Alerts.Origins) == 0 {
+				t.Fatalf("expected origins to be defaulted")
+			}
+		})
+	}
+}
+
+// TestLoadCredentialsFile ensures local_api_credentials.yaml maps onto crowdsec settings.
+func TestLoadCredentialsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "local_api_credentials.yaml")
+	content := "url: http://127.0.0.1:8080/\nlogin: agent\npassword: secret\nca_cert_path: /etc/crowdsec/ssl/ca.pem\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write credentials: %v", err)
+	}
+
+	creds, err := LoadCredentialsFile(path)
+	if err != nil {
+		t.Fatalf("load credentials: %v", err)
+	}
+
+	want := map[string]string{
+		"crowdsec.url":         "http://127.0.0.1:8080/",
+		"crowdsec.login":       "agent",
+		"crowdsec.password":    "secret",
+		"crowdsec.tls.ca_file": "/etc/crowdsec/ssl/ca.pem",
+	}
+	if got := creds.Settings(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected settings: %v", got)
+	}
+}
+
+// TestValidateDecisionLabels ensures decision labels are defaulted and unknown or repeated ones rejected.
+func TestValidateDecisionLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  []string
+		wantErr string
+	}{
+		{name: "defaults"},
+		{name: "optional labels", labels: []string{"scenario", "origin", "machine_id", "simulated"}},
+		{name: "unknown label", labels: []string{"scenario", "hostname"}, wantErr: `unknown label "hostname"`},
+		{name: "repeated label", labels: []string{"scenario", "scenario"}, wantErr: `label "scenario" is listed twice`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				CrowdSec: CrowdSecConfig{URL: "http://localhost:8080", Login: "machine", Password: "password"},
+				Exporter: ExporterConfig{DecisionLabels: tt.labels},
+			}
+
+			err := cfg.Validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(cfg.Exporter.DecisionLabels) == 0 {
+				t.Fatalf("expected decision labels to be defaulted")
+			}
+		})
+	}
+}
+
+// TestValidateAlertMetrics ensures alert metrics query every origin unless origins are configured.
+func TestValidateAlertMetrics(t *testing.T) {
+	cfg := &Config{
+		CrowdSec: CrowdSecConfig{URL: "http://localhost:8080", Login: "machine", Password: "secret"},
+		Exporter: ExporterConfig{AlertMetrics: true},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.CrowdSec.Alerts.Origins; len(got) != 1 || got[0] != AnyOrigin {
+		t.Fatalf("expected origins to default to %q, got %v", AnyOrigin, got)
+	}
+
+	cfg.CrowdSec.Alerts.Origins = []string{"cscli"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.CrowdSec.Alerts.Origins; len(got) != 1 || got[0] != "cscli" {
+		t.Fatalf("expected configured origins to be kept, got %v", got)
+	}
+
+	cfg = &Config{
+		CrowdSec: CrowdSecConfig{URL: "http://localhost:8080", APIKey: "key"},
+		Exporter: ExporterConfig{AlertMetrics: true},
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "exporter.alert_metrics requires alerts") {
+		t.Fatalf("expected alert metrics to be rejected with an API key, got %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Credentials mirrors CrowdSec's local_api_credentials.yaml as written by `cscli machines add`
+type Credentials struct {
+	URL        string `yaml:"url"`
+	Login      string `yaml:"login"`
+	Password   string `yaml:"password"`
+	CACertPath string `yaml:"ca_cert_path"`
+	KeyPath    string `yaml:"key_path"`
+	CertPath   string `yaml:"cert_path"`
+}
+
+// LoadCredentialsFile parses a local_api_credentials.yaml file
+func LoadCredentialsFile(path string) (*Credentials, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read credentials file: %w", err)
+	}
+
+	creds := &Credentials{}
+	if err := yaml.Unmarshal(b, creds); err != nil {
+		return nil, fmt.Errorf("parse credentials file %s: %w", path, err)
+	}
+	return creds, nil
+}
+
+// Settings returns the credentials keyed by their CrowdSecConfig setting name,
+// omitting values the file leaves empty
+func (c *Credentials) Settings() map[string]string {
+	all := map[string]string{
+		"crowdsec.url":           c.URL,
+		"crowdsec.login":         c.Login,
+		"crowdsec.password":      c.Password,
+		"crowdsec.tls.ca_file":   c.CACertPath,
+		"crowdsec.tls.key_file":  c.KeyPath,
+		"crowdsec.tls.cert_file": c.CertPath,
+	}
+
+	settings := make(map[string]string, len(all))
+	for key, value := range all {
+		if value != "" {
+			settings[key] = value
+		}
+	}
+	return settings
+}
@@ -2,61 +2,52 @@ package crowdsec
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log/slog"
 	"net/http"
 	"strings"
-	"sync"
 	"time"
-
-	"github.com/hydazz/crowdsec-exporter/internal/config"
 )
 
-var AuthToken struct {
-	mu            sync.Mutex
-	Expire        time.Time
-	BearerToken   string
-	Config        *config.Config
-	isRegistered  bool
-	machineLogin  string
-	machinePasswd string
-}
-
-func InitializeToken(cfg *config.Config) {
-	AuthToken.mu.Lock()
-	defer AuthToken.mu.Unlock()
-
-	AuthToken.Expire = time.Now()
-	AuthToken.BearerToken = ""
-	AuthToken.Config = cfg
-	AuthToken.isRegistered = false
-
-	AuthToken.machineLogin = cfg.CrowdSec.Login
-	AuthToken.machinePasswd = cfg.CrowdSec.Password
+// CheckAuth registers the machine if needed and refreshes an expired token
+func (c *Client) CheckAuth(ctx context.Context) error {
+	// Bouncer keys are presented on every request, there is no token to manage
+	if !c.usesToken() {
+		return nil
+	}
 
-	if cfg.CrowdSec.RegistrationToken == "" {
-		AuthToken.isRegistered = true
+	// Fast path so scrapes never wait on a background refresh while the token is still valid
+	if c.tokenValid() {
+		return nil
 	}
+
+	return c.ensureToken(ctx, false)
 }
 
-func CheckAuth() error {
-	AuthToken.mu.Lock()
-	defer AuthToken.mu.Unlock()
+// ensureToken registers the machine if needed and logs in when the token is
+// expired or force is set. Logins are serialised by c.mu while readers keep
+// using the current token; waiting for another login ends with ctx.
+func (c *Client) ensureToken(ctx context.Context, force bool) error {
+	if err := c.mu.LockContext(ctx); err != nil {
+		return fmt.Errorf("wait for login: %w", err)
+	}
+	defer c.mu.Unlock()
 
-	slog.Debug("CheckAuth", "isRegistered", AuthToken.isRegistered, "hasRegToken", AuthToken.Config.CrowdSec.RegistrationToken != "", "tokenExpired", AuthToken.Expire.Before(time.Now()))
+	c.logger.Debug("CheckAuth", "isRegistered", c.isRegistered.Load(), "hasRegToken", c.registrationToken != "", "tokenExpired", !c.tokenValid())
 
-	if !AuthToken.isRegistered && AuthToken.Config.CrowdSec.RegistrationToken != "" {
-		if err := registerMachine(); err != nil {
+	if c.usesPassword() && !c.isRegistered.Load() && c.registrationToken != "" {
+		if _, err := c.registerMachine(ctx); err != nil {
 			return fmt.Errorf("register machine: %w", err)
 		}
-		AuthToken.Expire = time.Now()
+		c.setToken("", time.Now())
 	}
 
-	if AuthToken.Expire.Before(time.Now()) {
-		slog.Debug("authenticate", "machineId", AuthToken.machineLogin)
-		if err := authenticate(); err != nil {
+	if force || !c.tokenValid() {
+		c.logger.Debug("authenticate", "machineId", c.machineLogin)
+		if err := c.authenticate(ctx); err != nil {
 			return fmt.Errorf("authenticate: %w", err)
 		}
 	}
@@ -64,24 +55,32 @@ func CheckAuth() error {
 	return nil
 }
 
-func GetToken() string { return AuthToken.BearerToken }
-
-func authenticate() error {
-	payload := struct {
-		Machine_id string `json:"machine_id"`
-		Password   string `json:"password"`
-	}{
-		Machine_id: AuthToken.machineLogin,
-		Password:   AuthToken.machinePasswd,
+// authenticate logs in to LAPI, c.mu must be held. Certificate-authenticated agents
+// send no credentials: LAPI identifies them by the certificate presented during the handshake.
+func (c *Client) authenticate(ctx context.Context) error {
+	var payload struct {
+		Machine_id string `json:"machine_id,omitempty"`
+		Password   string `json:"password,omitempty"`
+	}
+	if c.usesPassword() {
+		payload.Machine_id = c.machineLogin
+		payload.Password = c.machinePasswd
 	}
 
-	res, body, err := postJSON(AuthToken.Config.CrowdSec.URL+"/v1/watchers/login", payload)
+	res, body, err := c.postJSON(ctx, c.baseURL+"/v1/watchers/login", payload)
 	if err != nil {
+		c.stats.recordLogin(LoginFailureNetwork)
 		return fmt.Errorf("auth request: %w", err)
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode != http.StatusOK {
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		c.stats.recordLogin(LoginFailureBadCredentials)
+		return fmt.Errorf("auth failed: status=%d machineId=%s body=%s", res.StatusCode, payload.Machine_id, string(body))
+	default:
+		c.stats.recordLogin(LoginFailureStatus)
 		return fmt.Errorf("auth failed: status=%d machineId=%s body=%s", res.StatusCode, payload.Machine_id, string(body))
 	}
 
@@ -90,54 +89,87 @@ func authenticate() error {
 		Expire string `json:"expire"`
 	}
 	if err := json.Unmarshal(body, &tr); err != nil {
+		c.stats.recordLogin(LoginFailureDecode)
 		return fmt.Errorf("auth decode: %w", err)
 	}
 
-	AuthToken.BearerToken = tr.Token
-	AuthToken.Expire = parseExpire(tr.Expire)
+	c.setToken(tr.Token, c.parseExpire(tr.Expire))
+	c.stats.recordLogin("")
 	return nil
 }
 
-func registerMachine() error {
-	machineId := AuthToken.Config.CrowdSec.Login
-	password := AuthToken.Config.CrowdSec.Password
+// ErrAuthMode is returned when an operation is not available for the configured authentication mode
+var ErrAuthMode = errors.New("operation requires login/password authentication")
 
-	slog.Debug("checking if machine already exists", "machineId", machineId)
-	if tryAuthenticate(machineId, password) {
-		slog.Info("machine already registered and accessible", "machineId", machineId)
-		AuthToken.isRegistered = true
-		return nil
+// AuthError is returned when a request could not be authenticated before being sent
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string { return "check auth: " + e.Err.Error() }
+func (e *AuthError) Unwrap() error { return e.Err }
+
+// RegistrationStatus describes the outcome of a registration attempt
+type RegistrationStatus string
+
+const (
+	// RegistrationCreated means LAPI accepted a new watcher
+	RegistrationCreated RegistrationStatus = "registered"
+	// RegistrationExisting means the watcher already existed with these credentials
+	RegistrationExisting RegistrationStatus = "already registered"
+)
+
+// Register performs token-based registration of the configured machine
+func (c *Client) Register(ctx context.Context) (RegistrationStatus, error) {
+	if !c.usesPassword() || c.registrationToken == "" {
+		return "", fmt.Errorf("registration requires crowdsec.registration_token: %w", ErrAuthMode)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.registerMachine(ctx)
+}
+
+func (c *Client) registerMachine(ctx context.Context) (RegistrationStatus, error) {
+	machineId := c.machineLogin
+	password := c.machinePasswd
+
+	c.logger.Debug("checking if machine already exists", "machineId", machineId)
+	if c.tryAuthenticate(ctx, machineId, password) {
+		c.logger.Info("machine already registered and accessible", "machineId", machineId)
+		c.isRegistered.Store(true)
+		return RegistrationExisting, nil
 	}
 
 	data := regPayload{
 		MachineId:         machineId,
 		Password:          password,
-		RegistrationToken: AuthToken.Config.CrowdSec.RegistrationToken,
+		RegistrationToken: c.registrationToken,
 	}
 
-	slog.Debug("attempting registration", "machineId", data.MachineId)
-	res, body, err := postJSON(AuthToken.Config.CrowdSec.URL+"/v1/watchers", data)
+	c.logger.Debug("attempting registration", "machineId", data.MachineId)
+	res, body, err := c.postJSON(ctx, c.baseURL+"/v1/watchers", data)
 	if err != nil {
-		return fmt.Errorf("register request: %w", err)
+		return "", fmt.Errorf("register request: %w", err)
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode == http.StatusCreated || res.StatusCode == http.StatusAccepted {
-		slog.Info("successfully registered machine", "machineId", machineId)
-		setRegistered(data)
-		return nil
+		c.logger.Info("successfully registered machine", "machineId", machineId)
+		c.setRegistered(data)
+		return RegistrationCreated, nil
 	}
 
 	if res.StatusCode == http.StatusForbidden && strings.Contains(string(body), "user already exist") {
-		slog.Info("machine already exists, proceeding with provided credentials", "machineId", machineId)
-		setRegistered(data)
-		return nil
+		c.logger.Info("machine already exists, proceeding with provided credentials", "machineId", machineId)
+		c.setRegistered(data)
+		return RegistrationExisting, nil
 	}
 
-	return fmt.Errorf("registration failed: status=%d body=%s", res.StatusCode, string(body))
+	return "", fmt.Errorf("registration failed: status=%d body=%s", res.StatusCode, string(body))
 }
 
-func tryAuthenticate(machineId, password string) bool {
+func (c *Client) tryAuthenticate(ctx context.Context, machineId, password string) bool {
 	payload := struct {
 		Machine_id string `json:"machine_id"`
 		Password   string `json:"password"`
@@ -146,7 +178,7 @@ func tryAuthenticate(machineId, password string) bool {
 		Password:   password,
 	}
 
-	res, _, err := postJSON(AuthToken.Config.CrowdSec.URL+"/v1/watchers/login", payload)
+	res, _, err := c.postJSON(ctx, c.baseURL+"/v1/watchers/login", payload)
 	if err != nil {
 		return false
 	}
@@ -161,59 +193,130 @@ type regPayload struct {
 	RegistrationToken string `json:"registration_token,omitempty"`
 }
 
-func DeregisterMachine() error {
-	AuthToken.mu.Lock()
-	defer AuthToken.mu.Unlock()
+// DeregisterMachine removes the watcher from LAPI when deregister_on_exit is set
+func (c *Client) DeregisterMachine(ctx context.Context) error {
+	if !c.config.CrowdSec.DeregisterOnExit {
+		c.logger.Debug("deregistration disabled")
+		return nil
+	}
 
-	if !AuthToken.Config.CrowdSec.DeregisterOnExit {
-		slog.Debug("deregistration disabled")
+	if !c.usesPassword() {
+		c.logger.Debug("deregistration skipped", "auth_mode", c.config.CrowdSec.AuthMode())
 		return nil
 	}
 
-	if !AuthToken.isRegistered || AuthToken.machineLogin == "" {
+	c.mu.Lock()
+	registered := c.isRegistered.Load() && c.machineLogin != ""
+	c.mu.Unlock()
+	if !registered {
 		return nil
 	}
-	if AuthToken.Expire.Before(time.Now()) {
-		if err := authenticate(); err != nil {
-			return err
-		}
+
+	return c.Deregister(ctx)
+}
+
+// Deregister removes the configured watcher from LAPI
+func (c *Client) Deregister(ctx context.Context) error {
+	if !c.usesPassword() {
+		return ErrAuthMode
 	}
 
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/v1/watchers/%s", AuthToken.Config.CrowdSec.URL, AuthToken.machineLogin), nil)
-	if err != nil {
-		return fmt.Errorf("deregister request build: %w", err)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.machineLogin == "" {
+		return errors.New("no machine id configured")
+	}
+	if !c.tokenValid() {
+		if err := c.authenticate(ctx); err != nil {
+			return fmt.Errorf("authenticate: %w", err)
+		}
 	}
-	req.Header.Set("Authorization", "Bearer "+AuthToken.BearerToken)
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := c.deleteWatcher(ctx)
 	if err != nil {
-		return fmt.Errorf("deregister request: %w", err)
+		return err
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		res.Body.Close()
+		c.logger.Info("token rejected by LAPI, re-authenticating", "machine_id", c.machineLogin)
+		c.stats.recordForcedReauth()
+		if err := c.authenticate(ctx); err != nil {
+			return fmt.Errorf("authenticate: %w", err)
+		}
+		if res, err = c.deleteWatcher(ctx); err != nil {
+			return err
+		}
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusNoContent {
-		slog.Info("deregistered", "machine_id", AuthToken.machineLogin)
-		clearRegistration()
+		c.logger.Info("deregistered", "machine_id", c.machineLogin)
+		c.clearRegistration()
 		return nil
 	}
 
 	body, _ := io.ReadAll(res.Body)
-	slog.Warn("deregister failed", "status", res.StatusCode, "machine_id", AuthToken.machineLogin, "body", string(body))
-	return nil
+	return fmt.Errorf("deregister failed: status=%d machineId=%s body=%s", res.StatusCode, c.machineLogin, string(body))
+}
+
+// Login authenticates with LAPI immediately, even if the current token is still valid
+func (c *Client) Login(ctx context.Context) error {
+	if !c.usesToken() {
+		return ErrAuthMode
+	}
+	return c.ensureToken(ctx, true)
+}
+
+// MachineID returns the watcher identity used against LAPI
+func (c *Client) MachineID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.machineLogin
+}
+
+// deleteWatcher sends the deregistration request, c.mu must be held
+func (c *Client) deleteWatcher(ctx context.Context) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf("%s/v1/watchers/%s", c.baseURL, c.machineLogin), nil)
+	if err != nil {
+		return nil, fmt.Errorf("deregister request build: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token())
+
+	res, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("deregister request: %w", err)
+	}
+	return res, nil
+}
+
+// invalidateToken discards the token LAPI rejected so the next CheckAuth logs in again.
+// Concurrent callers holding the same stale token only trigger a single re-login.
+func (c *Client) invalidateToken(stale string) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+
+	if c.bearerToken != stale {
+		return
+	}
+	c.logger.Info("token rejected by LAPI, re-authenticating")
+	c.stats.recordForcedReauth()
+	c.bearerToken = ""
+	c.expire = time.Now()
 }
 
-func postJSON(url string, v any) (*http.Response, []byte, error) {
+func (c *Client) postJSON(ctx context.Context, url string, v any) (*http.Response, []byte, error) {
 	b, err := json.Marshal(v)
 	if err != nil {
 		return nil, nil, fmt.Errorf("marshal: %w", err)
 	}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(b))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(b))
 	if err != nil {
 		return nil, nil, fmt.Errorf("request build: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := c.do(req)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -221,28 +324,27 @@ func postJSON(url string, v any) (*http.Response, []byte, error) {
 	return res, body, nil
 }
 
-func parseExpire(s string) time.Time {
+func (c *Client) parseExpire(s string) time.Time {
 	if s == "" {
 		return time.Now().Add(time.Hour)
 	}
 	t, err := time.Parse(time.RFC3339, s)
 	if err != nil {
-		slog.Warn("expire parse", "value", s, "error", err)
+		c.logger.Warn("expire parse", "value", s, "error", err)
 		return time.Now().Add(time.Hour)
 	}
 	return t
 }
 
-func setRegistered(p regPayload) {
-	AuthToken.machineLogin = p.MachineId
-	AuthToken.machinePasswd = p.Password
-	AuthToken.isRegistered = true
+func (c *Client) setRegistered(p regPayload) {
+	c.machineLogin = p.MachineId
+	c.machinePasswd = p.Password
+	c.isRegistered.Store(true)
 }
 
-func clearRegistration() {
-	AuthToken.isRegistered = false
-	AuthToken.machineLogin = ""
-	AuthToken.machinePasswd = ""
-	AuthToken.BearerToken = ""
-	AuthToken.Expire = time.Now()
+func (c *Client) clearRegistration() {
+	c.isRegistered.Store(false)
+	c.machineLogin = ""
+	c.machinePasswd = ""
+	c.setToken("", time.Now())
 }
@@ -0,0 +1,211 @@
+package crowdsec
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hydazz/crowdsec-exporter/internal/config"
+)
+
+// Client talks to a single CrowdSec Local API with a single machine identity.
+// It owns its token state, so several clients can run side by side.
+type Client struct {
+	config     *config.Config
+	baseURL    string
+	httpClient *http.Client
+	logger     *slog.Logger
+
+	// mu serialises registration, login and deregistration
+	mu                ctxMutex
+	machineLogin      string
+	machinePasswd     string
+	registrationToken string
+
+	// tokenMu guards the current token so it stays readable during a login
+	tokenMu     sync.RWMutex
+	expire      time.Time
+	bearerToken string
+
+	isRegistered atomic.Bool
+	stats        authStats
+	requests     requestStats
+	stream       decisionSet
+
+	// observer receives the duration of every LAPI request, see SetRequestObserver
+	observer atomic.Pointer[RequestObserver]
+}
+
+// ctxMutex is a mutex whose waiters can give up when their context ends, so a
+// scrape never outlives its deadline waiting on a login started elsewhere
+type ctxMutex chan struct{}
+
+func (m ctxMutex) Lock()   { m <- struct{}{} }
+func (m ctxMutex) Unlock() { <-m }
+
+// LockContext acquires m or returns the context error once ctx is done
+func (m ctxMutex) LockContext(ctx context.Context) error {
+	select {
+	case m <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RequestObserver is called after each LAPI request with its endpoint route, its HTTP
+// status code or "error" when no response was received, and how long it took
+type RequestObserver func(endpoint, status string, duration time.Duration)
+
+// SetRequestObserver installs observe to be called after every LAPI request
+func (c *Client) SetRequestObserver(observe RequestObserver) {
+	c.observer.Store(&observe)
+}
+
+// RequestContext bounds LAPI work started outside a scrape by crowdsec.request_timeout
+func (c *Client) RequestContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if timeout := c.config.CrowdSec.RequestTimeout; timeout > 0 {
+		return context.WithTimeout(parent, timeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// do sends req and reports its duration to the request observer
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := c.httpClient.Do(req)
+
+	if observe := c.observer.Load(); observe != nil {
+		status := "error"
+		if err == nil {
+			status = strconv.Itoa(res.StatusCode)
+		}
+		(*observe)(route(req.URL.Path), status, time.Since(start))
+	}
+	return res, err
+}
+
+// route returns the LAPI route template matching path, so per-machine paths
+// share one endpoint label
+func route(path string) string {
+	if rest, ok := strings.CutPrefix(path, "/v1/watchers/"); ok && rest != "login" {
+		return "/v1/watchers/:machine_id"
+	}
+	return path
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for all LAPI requests
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithLogger sets the logger used by the client
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// NewClient creates a CrowdSec LAPI client for the given configuration
+func NewClient(cfg *config.Config, opts ...Option) (*Client, error) {
+	c := &Client{
+		config:            cfg,
+		baseURL:           baseURL(cfg.CrowdSec.URL),
+		logger:            slog.Default(),
+		mu:                make(ctxMutex, 1),
+		expire:            time.Now(),
+		machineLogin:      cfg.CrowdSec.Login,
+		machinePasswd:     cfg.CrowdSec.Password,
+		registrationToken: cfg.CrowdSec.RegistrationToken,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if _, err := c.loadSecrets(); err != nil {
+		return nil, err
+	}
+
+	if c.registrationToken == "" {
+		c.isRegistered.Store(true)
+	} else if c.usesPassword() {
+		if err := c.resolveIdentity(); err != nil {
+			return nil, fmt.Errorf("machine identity: %w", err)
+		}
+	}
+
+	if c.httpClient == nil {
+		hc, err := newHTTPClient(cfg.CrowdSec)
+		if err != nil {
+			return nil, fmt.Errorf("http client: %w", err)
+		}
+		c.httpClient = hc
+	}
+
+	if cfg.CrowdSec.TLS.InsecureSkipVerify {
+		c.logger.Warn("LAPI server certificate verification is disabled")
+	}
+
+	return c, nil
+}
+
+// Token returns the current bearer token
+func (c *Client) Token() string {
+	c.tokenMu.RLock()
+	defer c.tokenMu.RUnlock()
+	return c.bearerToken
+}
+
+// Expire returns when the current bearer token expires
+func (c *Client) Expire() time.Time {
+	c.tokenMu.RLock()
+	defer c.tokenMu.RUnlock()
+	return c.expire
+}
+
+// tokenValid reports whether a token is held and has not yet expired
+func (c *Client) tokenValid() bool {
+	c.tokenMu.RLock()
+	defer c.tokenMu.RUnlock()
+	return c.bearerToken != "" && c.expire.After(time.Now())
+}
+
+func (c *Client) setToken(token string, expire time.Time) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	c.bearerToken = token
+	c.expire = expire
+}
+
+// usesToken reports whether the client authenticates with a watcher JWT.
+// Certificate-authenticated agents log in too, presenting the certificate instead of a password.
+func (c *Client) usesToken() bool {
+	return c.config.CrowdSec.AuthMode() != config.AuthModeAPIKey
+}
+
+// usesPassword reports whether the watcher logs in with a machine id and password
+func (c *Client) usesPassword() bool {
+	return c.config.CrowdSec.AuthMode() == config.AuthModePassword
+}
+
+// authorize sets the credentials required by LAPI on req
+func (c *Client) authorize(req *http.Request) {
+	switch c.config.CrowdSec.AuthMode() {
+	case config.AuthModeAPIKey:
+		req.Header.Set("X-Api-Key", c.config.CrowdSec.APIKey)
+	default:
+		req.Header.Set("Authorization", "Bearer "+c.Token())
+	}
+}
@@ -0,0 +1,522 @@
+package crowdsec
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hydazz/crowdsec-exporter/internal/config"
+)
+
+type roundTripper func(req *http.Request) (*http.Response, error)
+
+func (rt roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return rt(req)
+}
+
+func newResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode:    status,
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Header:        make(http.Header),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+func newTestClient(t *testing.T, rt roundTripper) *Client {
+	t.Helper()
+
+	cfg := &config.Config{
+		CrowdSec: config.CrowdSecConfig{
+			URL:      "http://crowdsec.local",
+			Login:    "machine",
+			Password: "password",
+		},
+	}
+	c, err := NewClient(cfg, WithHTTPClient(&http.Client{Transport: rt}))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	return c
+}
+
+// TestReauthenticateOnUnauthorized ensures a rejected token triggers one re-login and a replay.
+func TestReauthenticateOnUnauthorized(t *testing.T) {
+	var logins int32
+	var alerts int32
+
+	c := newTestClient(t, func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/v1/watchers/login":
+			n := atomic.AddInt32(&logins, 1)
+			payload := fmt.Sprintf(`{"token":"token-%d","expire":"%s"}`, n, time.Now().Add(time.Hour).Format(time.RFC3339))
+			return newResponse(http.StatusOK, payload), nil
+		case "/v1/alerts":
+			atomic.AddInt32(&alerts, 1)
+			if req.Header.Get("Authorization") != "Bearer token-2" {
+				return newResponse(http.StatusUnauthorized, `{"message":"token is expired"}`), nil
+			}
+			return newResponse(http.StatusOK, `[]`), nil
+		default:
+			return nil, fmt.Errorf("unexpected path: %s", req.URL.Path)
+		}
+	})
+
+	if _, _, err := c.QueryAlerts(context.Background(), 0); err != nil {
+		t.Fatalf("query alerts: %v", err)
+	}
+
+	if got := atomic.LoadInt32(&logins); got != 2 {
+		t.Fatalf("expected 2 logins, got %d", got)
+	}
+	if got := atomic.LoadInt32(&alerts); got != 2 {
+		t.Fatalf("expected 2 alerts requests, got %d", got)
+	}
+	stats := c.AuthStats()
+	if stats.ForcedReauths != 1 {
+		t.Fatalf("expected 1 forced re-authentication, got %d", stats.ForcedReauths)
+	}
+	if stats.LoginAttempts != 2 || stats.LastLogin.IsZero() {
+		t.Fatalf("expected 2 successful logins, got %+v", stats)
+	}
+}
+
+// TestCertificateLogin ensures certificate-authenticated agents log in without a password and send the token.
+func TestCertificateLogin(t *testing.T) {
+	var logins int32
+
+	cfg := &config.Config{
+		CrowdSec: config.CrowdSecConfig{
+			URL: "https://crowdsec.local",
+			TLS: config.TLSConfig{CertFile: "agent.pem", KeyFile: "agent-key.pem"},
+		},
+	}
+	c, err := NewClient(cfg, WithHTTPClient(&http.Client{Transport: roundTripper(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/v1/watchers/login":
+			n := atomic.AddInt32(&logins, 1)
+			body, _ := io.ReadAll(req.Body)
+			if strings.Contains(string(body), "password") || strings.Contains(string(body), "machine_id") {
+				return nil, fmt.Errorf("unexpected credentials in login body: %s", body)
+			}
+			payload := fmt.Sprintf(`{"token":"token-%d","expire":"%s"}`, n, time.Now().Add(time.Hour).Format(time.RFC3339))
+			return newResponse(http.StatusOK, payload), nil
+		case "/v1/alerts":
+			if req.Header.Get("Authorization") != "Bearer token-2" {
+				return newResponse(http.StatusUnauthorized, `{"message":"token is expired"}`), nil
+			}
+			return newResponse(http.StatusOK, `[]`), nil
+		default:
+			return nil, fmt.Errorf("unexpected path: %s", req.URL.Path)
+		}
+	})}))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	if _, _, err := c.QueryAlerts(context.Background(), 0); err != nil {
+		t.Fatalf("query alerts: %v", err)
+	}
+
+	if got := atomic.LoadInt32(&logins); got != 2 {
+		t.Fatalf("expected a login and a re-login after the 401, got %d logins", got)
+	}
+	if stats := c.AuthStats(); stats.ForcedReauths != 1 || stats.LastLogin.IsZero() {
+		t.Fatalf("expected auth stats to be recorded, got %+v", stats)
+	}
+}
+
+// TestGeneratedIdentityPersists ensures auto-registered machines reuse their identity across restarts.
+func TestGeneratedIdentityPersists(t *testing.T) {
+	cfg := &config.Config{
+		CrowdSec: config.CrowdSecConfig{
+			URL:               "http://crowdsec.local",
+			RegistrationToken: "token",
+			MachineName:       "exporter/replica 0",
+			StateFile:         filepath.Join(t.TempDir(), "state", "machine.json"),
+		},
+	}
+
+	var registered []regPayload
+	rt := roundTripper(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/v1/watchers/login":
+			return newResponse(http.StatusForbidden, `{"message":"machine not found"}`), nil
+		case "/v1/watchers":
+			var p regPayload
+			if err := json.NewDecoder(req.Body).Decode(&p); err != nil {
+				return nil, err
+			}
+			registered = append(registered, p)
+			return newResponse(http.StatusCreated, ``), nil
+		default:
+			return nil, fmt.Errorf("unexpected path: %s", req.URL.Path)
+		}
+	})
+
+	for i := 0; i < 2; i++ {
+		c, err := NewClient(cfg, WithHTTPClient(&http.Client{Transport: rt}))
+		if err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+		c.mu.Lock()
+		_, err = c.registerMachine(context.Background())
+		c.mu.Unlock()
+		if err != nil {
+			t.Fatalf("register machine: %v", err)
+		}
+	}
+
+	if len(registered) != 2 {
+		t.Fatalf("expected 2 registrations, got %d", len(registered))
+	}
+	if registered[0].MachineId != "exporter-replica-0" {
+		t.Fatalf("unexpected machine id %q", registered[0].MachineId)
+	}
+	if registered[0].Password == "" || registered[0] != registered[1] {
+		t.Fatalf("expected identical non-empty identities, got %+v and %+v", registered[0], registered[1])
+	}
+}
+
+// TestQueryAlertsDecoding ensures the full alert schema is decoded and type mismatches are reported.
+func TestQueryAlertsDecoding(t *testing.T) {
+	payload := `[{"id":42,"machine_id":"agent","scenario":"crowdsecurity/ssh-bf","events_count":6,"capacity":5,"leakspeed":"10s","simulated":false,"remediation":true,"labels":["ssh"],"created_at":"2025-01-01T00:00:00Z","meta":[{"key":"service","value":"ssh"}],"source":{"scope":"Ip","value":"1.2.3.4","ip":"1.2.3.4","cn":"FR","latitude":48.8566,"longitude":2.3522},"decisions":[{"id":7,"origin":"crowdsec","type":"ban","scope":"Ip","value":"1.2.3.4","duration":"3h59m","until":"2025-01-01T04:00:00Z","scenario":"crowdsecurity/ssh-bf"}]}]`
+
+	c := newTestClient(t, func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/v1/watchers/login":
+			return newResponse(http.StatusOK, fmt.Sprintf(`{"token":"t","expire":"%s"}`, time.Now().Add(time.Hour).Format(time.RFC3339))), nil
+		case "/v1/alerts":
+			return newResponse(http.StatusOK, payload), nil
+		default:
+			return nil, fmt.Errorf("unexpected path: %s", req.URL.Path)
+		}
+	})
+
+	alerts, _, err := c.QueryAlerts(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("query alerts: %v", err)
+	}
+	if len(alerts) != 1 || len(alerts[0].Decisions) != 1 {
+		t.Fatalf("unexpected alerts: %+v", alerts)
+	}
+
+	a := alerts[0]
+	if a.ID != 42 || a.MachineID != "agent" || a.EventsCount != 6 || a.Capacity != 5 || a.Leakspeed != "10s" || !a.Remediation {
+		t.Fatalf("alert fields not decoded: %+v", a)
+	}
+	if a.SourceScope != "Ip" || a.SourceValue != "1.2.3.4" || len(a.Meta) != 1 || len(a.Labels) != 1 {
+		t.Fatalf("alert source/meta not decoded: %+v", a)
+	}
+
+	d := a.Decisions[0]
+	if d.Until != "2025-01-01T04:00:00Z" || d.CreatedAt != "2025-01-01T00:00:00Z" || d.Origin != "crowdsec" || d.Country != "FR" {
+		t.Fatalf("decision fields not decoded: %+v", d)
+	}
+	if d.Duration != "4h0m0s" {
+		t.Fatalf("expected the original duration from until and created_at, got %q", d.Duration)
+	}
+
+	payload = `[{"id":42,"source":{"latitude":"north"}}]`
+	if _, _, err := c.QueryAlerts(context.Background(), 0); err == nil || !strings.Contains(err.Error(), "decode alerts") {
+		t.Fatalf("expected decode error, got %v", err)
+	}
+}
+
+// TestQueryAlertsFilters ensures filters are sent to LAPI and each origin is queried once.
+func TestQueryAlertsFilters(t *testing.T) {
+	var queries []string
+	c := newTestClient(t, func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/v1/watchers/login":
+			return newResponse(http.StatusOK, fmt.Sprintf(`{"token":"t","expire":"%s"}`, time.Now().Add(time.Hour).Format(time.RFC3339))), nil
+		case "/v1/alerts":
+			queries = append(queries, req.URL.RawQuery)
+			// Alert 2 carries decisions from both origins and is returned twice
+			if req.URL.Query().Get("origin") == "crowdsec" {
+				return newResponse(http.StatusOK, `[{"id":1},{"id":2}]`), nil
+			}
+			return newResponse(http.StatusOK, `[{"id":2},{"id":3}]`), nil
+		default:
+			return nil, fmt.Errorf("unexpected path: %s", req.URL.Path)
+		}
+	})
+	c.config.CrowdSec.Alerts = config.AlertsConfig{
+		Origins:           []string{"crowdsec", "cscli"},
+		Scenario:          "crowdsecurity/ssh-bf",
+		Since:             24 * time.Hour,
+		HasActiveDecision: true,
+	}
+	c.config.CrowdSec.PageSize = 10
+
+	alerts, _, err := c.QueryAlerts(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("query alerts: %v", err)
+	}
+	if len(alerts) != 3 {
+		t.Fatalf("expected 3 merged alerts, got %d", len(alerts))
+	}
+
+	want := []string{
+		"has_active_decision=true&limit=10&origin=crowdsec&scenario=crowdsecurity%2Fssh-bf&since=24h0m0s",
+		"has_active_decision=true&limit=10&origin=cscli&scenario=crowdsecurity%2Fssh-bf&since=24h0m0s",
+	}
+	if strings.Join(queries, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected queries:\n%s", strings.Join(queries, "\n"))
+	}
+
+	// Any origin sends a single query without an origin filter
+	queries = nil
+	c.config.CrowdSec.Alerts = config.AlertsConfig{Origins: []string{config.AnyOrigin}}
+	if _, _, err := c.QueryAlerts(context.Background(), 0); err != nil {
+		t.Fatalf("query alerts: %v", err)
+	}
+	if len(queries) != 1 || queries[0] != "limit=10" {
+		t.Fatalf("unexpected queries:\n%s", strings.Join(queries, "\n"))
+	}
+}
+
+// TestQueryAlertsPaging ensures alerts are paged with a created_before cursor and capped by max_results.
+func TestQueryAlertsPaging(t *testing.T) {
+	// LAPI stores sub-second creation times but reports them, and its Date header, in whole seconds
+	now := time.Now().UTC().Truncate(time.Second).Add(100 * time.Millisecond)
+	second := func(ago time.Duration) time.Time { return now.Truncate(time.Second).Add(-ago) }
+
+	// Alert 4 shares a second with 5 and falls past the first page boundary;
+	// alerts 1-3 share a second and outnumber a page
+	created := map[int64]time.Time{
+		6: second(1 * time.Minute),
+		5: second(2 * time.Minute).Add(700 * time.Millisecond),
+		4: second(2 * time.Minute).Add(200 * time.Millisecond),
+		3: second(3 * time.Minute).Add(900 * time.Millisecond),
+		2: second(3 * time.Minute).Add(500 * time.Millisecond),
+		1: second(3 * time.Minute).Add(100 * time.Millisecond),
+	}
+
+	var requests int
+	rt := func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/v1/watchers/login":
+			return newResponse(http.StatusOK, fmt.Sprintf(`{"token":"t","expire":"%s"}`, time.Now().Add(time.Hour).Format(time.RFC3339))), nil
+		case "/v1/alerts":
+			requests++
+			q := req.URL.Query()
+			limit, _ := strconv.Atoi(q.Get("limit"))
+			before := now
+			if cb := q.Get("created_before"); cb != "" {
+				d, err := time.ParseDuration(cb)
+				if err != nil {
+					return nil, err
+				}
+				before = now.Add(-d)
+			}
+
+			var page []string
+			for id := int64(6); id >= 1 && len(page) < limit; id-- {
+				if !created[id].After(before) {
+					page = append(page, fmt.Sprintf(`{"id":%d,"created_at":"%s"}`, id, created[id].Format(time.RFC3339)))
+				}
+			}
+			res := newResponse(http.StatusOK, "["+strings.Join(page, ",")+"]")
+			res.Header.Set("Date", now.Format(http.TimeFormat))
+			return res, nil
+		default:
+			return nil, fmt.Errorf("unexpected path: %s", req.URL.Path)
+		}
+	}
+
+	c := newTestClient(t, rt)
+	c.config.CrowdSec.PageSize = 2
+
+	alerts, truncated, err := c.QueryAlerts(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("query alerts: %v", err)
+	}
+	if truncated || len(alerts) != 6 {
+		t.Fatalf("expected all 6 alerts, got %d (truncated %t)", len(alerts), truncated)
+	}
+	for i, a := range alerts {
+		if want := int64(6 - i); a.ID != want {
+			t.Fatalf("expected alert %d at position %d, got %d", want, i, a.ID)
+		}
+	}
+
+	requests = 0
+	c.config.CrowdSec.PageSize = 3
+	c.config.CrowdSec.MaxResults = 3
+	alerts, truncated, err = c.QueryAlerts(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("query alerts: %v", err)
+	}
+	if !truncated || len(alerts) != 3 {
+		t.Fatalf("expected 3 alerts and truncation, got %d (truncated %t)", len(alerts), truncated)
+	}
+	if requests != 2 {
+		t.Fatalf("expected paging to stop at the cap after 2 requests, got %d", requests)
+	}
+}
+
+// TestDecisionUntil ensures an expiry derived from the remaining duration does not drift between scrapes.
+func TestDecisionUntil(t *testing.T) {
+	if got := decisionUntil("2025-01-01T04:00:00Z", "3h59m"); got != "2025-01-01T04:00:00Z" {
+		t.Fatalf("expected the reported until to be kept, got %q", got)
+	}
+	if got := decisionUntil("", "permanent"); got != "" {
+		t.Fatalf("expected no until for an unparseable duration, got %q", got)
+	}
+
+	// Rounding absorbs the second or so the remaining duration drifts by between scrapes
+	want := time.Now().Add(4 * time.Hour)
+	got := decisionUntil("", "3h59m58.4s")
+	until, err := time.Parse(time.RFC3339, got)
+	if err != nil {
+		t.Fatalf("parse until %q: %v", got, err)
+	}
+	if until.Second() != 0 || until.Sub(want).Abs() > 31*time.Second {
+		t.Fatalf("expected an until rounded to the minute near %s, got %s", want.UTC().Format(time.RFC3339), got)
+	}
+}
+
+// TestDecisionStream ensures stream deltas are applied to the decision set.
+func TestDecisionStream(t *testing.T) {
+	responses := map[string]string{
+		"true":  `{"new":[{"id":1,"value":"1.2.3.4","type":"ban"},{"id":2,"value":"5.6.7.8","type":"ban"}],"deleted":null}`,
+		"false": `{"new":[{"id":3,"value":"9.9.9.9","type":"captcha"}],"deleted":[{"id":1,"value":"1.2.3.4","type":"ban"}]}`,
+	}
+	cfg := &config.Config{
+		CrowdSec: config.CrowdSecConfig{
+			URL:    "http://crowdsec.local",
+			APIKey: "key",
+			Stream: config.StreamConfig{Enabled: true, Interval: time.Second},
+		},
+	}
+	rt := roundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/v1/decisions/stream" || req.Header.Get("X-Api-Key") != "key" {
+			return nil, fmt.Errorf("unexpected request: %s", req.URL)
+		}
+		return newResponse(http.StatusOK, responses[req.URL.Query().Get("startup")]), nil
+	})
+	c, err := NewClient(cfg, WithHTTPClient(&http.Client{Transport: rt}))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	if _, ok := c.StreamedDecisions(); ok {
+		t.Fatalf("expected stream to be unsynced before the first poll")
+	}
+
+	for _, startup := range []bool{true, false} {
+		if err := c.pollDecisionStream(context.Background(), startup); err != nil {
+			t.Fatalf("poll stream: %v", err)
+		}
+	}
+
+	decisions, ok := c.StreamedDecisions()
+	if !ok {
+		t.Fatalf("expected stream to be synced")
+	}
+	var ids []int
+	for _, d := range decisions {
+		ids = append(ids, d.ID)
+	}
+	if fmt.Sprint(ids) != "[2 3]" {
+		t.Fatalf("expected decisions [2 3], got %v", ids)
+	}
+}
+
+// TestRetryClassification ensures only network errors, 429 and 5xx responses are retried.
+func TestRetryClassification(t *testing.T) {
+	var statuses []int
+	c := newTestClient(t, func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/v1/watchers/login":
+			return newResponse(http.StatusOK, fmt.Sprintf(`{"token":"t","expire":"%s"}`, time.Now().Add(time.Hour).Format(time.RFC3339))), nil
+		case "/v1/alerts":
+			status := statuses[0]
+			statuses = statuses[1:]
+			switch status {
+			case 0:
+				return nil, errors.New("connection reset by peer")
+			case http.StatusOK:
+				return newResponse(status, `[]`), nil
+			default:
+				return newResponse(status, `{"message":"something went wrong"}`), nil
+			}
+		default:
+			return nil, fmt.Errorf("unexpected path: %s", req.URL.Path)
+		}
+	})
+
+	statuses = []int{0, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}
+	if _, _, err := c.QueryAlerts(context.Background(), 3); err != nil {
+		t.Fatalf("expected retries to succeed, got %v", err)
+	}
+	if got := c.RetryStats()["/v1/alerts"]; got != 3 {
+		t.Fatalf("expected 3 retries, got %d", got)
+	}
+
+	statuses = []int{http.StatusBadRequest, http.StatusOK}
+	_, _, err := c.QueryAlerts(context.Background(), 3)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || !strings.Contains(apiErr.Body, "something went wrong") {
+		t.Fatalf("expected a 400 APIError with the body excerpt, got %v", err)
+	}
+	if len(statuses) != 1 {
+		t.Fatalf("expected a 400 not to be retried")
+	}
+
+	statuses = []int{http.StatusInternalServerError, http.StatusInternalServerError}
+	if _, _, err := c.QueryAlerts(context.Background(), 1); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected a 500 APIError once retries are exhausted, got %v", err)
+	}
+
+	if got := parseRetryAfter("3"); got != 3*time.Second {
+		t.Fatalf("expected Retry-After of 3s, got %s", got)
+	}
+	if got := c.retryDelay(0, &APIError{StatusCode: http.StatusTooManyRequests, RetryAfter: 2 * time.Second}); got != 2*time.Second {
+		t.Fatalf("expected Retry-After to take precedence, got %s", got)
+	}
+}
+
+// TestRequestObserver ensures request durations are reported by route, so machine ids do not become label values.
+func TestRequestObserver(t *testing.T) {
+	c := newTestClient(t, func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/v1/watchers/login":
+			return newResponse(http.StatusOK, fmt.Sprintf(`{"token":"t","expire":"%s"}`, time.Now().Add(time.Hour).Format(time.RFC3339))), nil
+		case "/v1/watchers/machine":
+			return newResponse(http.StatusNoContent, ""), nil
+		default:
+			return nil, fmt.Errorf("unexpected path: %s", req.URL.Path)
+		}
+	})
+	c.config.CrowdSec.DeregisterOnExit = true
+
+	var observed []string
+	c.SetRequestObserver(func(endpoint, status string, _ time.Duration) {
+		observed = append(observed, endpoint+" "+status)
+	})
+
+	if err := c.Deregister(context.Background()); err != nil {
+		t.Fatalf("deregister: %v", err)
+	}
+	if _, _, err := c.QueryDecisions(context.Background(), 0); err == nil {
+		t.Fatalf("expected the unexpected path to fail")
+	}
+
+	// Deregistering drops the token, so the query logs in again first
+	want := []string{"/v1/watchers/login 200", "/v1/watchers/:machine_id 204", "/v1/watchers/login 200", "/v1/decisions error"}
+	if strings.Join(observed, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected observations:\n%s", strings.Join(observed, "\n"))
+	}
+}
@@ -0,0 +1,71 @@
+package crowdsec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hydazz/crowdsec-exporter/internal/models"
+)
+
+// QueryDecisions fetches active decisions from /v1/decisions using the bouncer API key.
+// This endpoint carries no source information, so geo and ASN fields stay empty.
+// It cannot be paged, so crowdsec.max_results only bounds what is kept; truncated
+// reports whether decisions were dropped.
+func (c *Client) QueryDecisions(ctx context.Context, retry int) (decisions models.DecisionArray, truncated bool, err error) {
+	res, err := c.get(ctx, c.baseURL+"/v1/decisions", retry)
+	if err != nil {
+		return nil, false, err
+	}
+	defer res.Body.Close()
+
+	var raw []lapiDecision
+	if err := json.NewDecoder(res.Body).Decode(&raw); err != nil {
+		return nil, false, fmt.Errorf("decode decisions: %w", err)
+	}
+
+	if limit := c.config.CrowdSec.MaxResults; limit > 0 && len(raw) > limit {
+		raw, truncated = raw[:limit], true
+	}
+	return toDecisions(raw), truncated, nil
+}
+
+// StreamDecisions polls /v1/decisions/stream. With startup set, LAPI returns every
+// active decision; afterwards only decisions added or deleted since the last poll.
+func (c *Client) StreamDecisions(ctx context.Context, startup bool, retry int) (added, deleted models.DecisionArray, err error) {
+	url := fmt.Sprintf("%s/v1/decisions/stream?startup=%t", c.baseURL, startup)
+	res, err := c.get(ctx, url, retry)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	var raw struct {
+		New     []lapiDecision `json:"new"`
+		Deleted []lapiDecision `json:"deleted"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&raw); err != nil {
+		return nil, nil, fmt.Errorf("decode decision stream: %w", err)
+	}
+
+	return toDecisions(raw.New), toDecisions(raw.Deleted), nil
+}
+
+func toDecisions(raw []lapiDecision) models.DecisionArray {
+	decisions := make(models.DecisionArray, 0, len(raw))
+	for _, d := range raw {
+		decisions = append(decisions, models.Decision{
+			ID:        d.ID,
+			UUID:      d.UUID,
+			Scenario:  d.Scenario,
+			IPAddress: d.Value,
+			Type:      d.Type,
+			Scope:     d.Scope,
+			Origin:    d.Origin,
+			Simulated: d.Simulated,
+			Until:     decisionUntil(d.Until, d.Duration),
+			// Without a creation time only the remaining duration is known, which would churn the label
+		})
+	}
+	return decisions
+}
@@ -0,0 +1,102 @@
+package crowdsec
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// machineState is persisted to state_file so restarts reuse the same identity
+type machineState struct {
+	MachineID string `json:"machine_id"`
+	Password  string `json:"password"`
+}
+
+// resolveIdentity fills in the machine id and password used for auto-registration.
+// An explicit login wins, otherwise machine_name or the hostname is used. Without a
+// configured password one is generated and persisted to state_file.
+func (c *Client) resolveIdentity() error {
+	if c.machineLogin == "" {
+		name, err := machineName(c.config.CrowdSec.MachineName)
+		if err != nil {
+			return err
+		}
+		c.machineLogin = name
+	}
+
+	if c.machinePasswd == "" && c.config.CrowdSec.StateFile != "" {
+		password, err := loadOrCreatePassword(c.config.CrowdSec.StateFile, c.machineLogin)
+		if err != nil {
+			return err
+		}
+		c.machinePasswd = password
+	}
+
+	c.logger.Debug("resolved machine identity", "machineId", c.machineLogin)
+	return nil
+}
+
+// machineName returns a deterministic machine id derived from name or the hostname
+func machineName(name string) (string, error) {
+	if name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("resolve hostname: %w", err)
+		}
+		name = hostname
+	}
+
+	id := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '-'
+		}
+	}, name)
+	if id == "" {
+		return "", errors.New("machine name is empty")
+	}
+	return id, nil
+}
+
+// loadOrCreatePassword returns the password stored for machineID, generating and
+// persisting a new one when the state file is missing or belongs to another machine
+func loadOrCreatePassword(path, machineID string) (string, error) {
+	b, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		var state machineState
+		if err := json.Unmarshal(b, &state); err != nil {
+			return "", fmt.Errorf("decode state file %s: %w", path, err)
+		}
+		if state.MachineID == machineID && state.Password != "" {
+			return state.Password, nil
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return "", fmt.Errorf("read state file: %w", err)
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("generate password: %w", err)
+	}
+	state := machineState{MachineID: machineID, Password: base64.RawURLEncoding.EncodeToString(raw)}
+
+	b, err = json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("encode state file: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", fmt.Errorf("create state directory: %w", err)
+	}
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		return "", fmt.Errorf("write state file: %w", err)
+	}
+	return state.Password, nil
+}
@@ -0,0 +1,63 @@
+package crowdsec
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// refreshRetryInterval is how long the refresher waits after a failed login
+const refreshRetryInterval = 30 * time.Second
+
+// RunTokenRefresher renews the JWT token_refresh_margin ahead of its expiry until
+// ctx is cancelled, so scrapes never pay for a login. Each renewal is brought forward
+// by a random jitter of up to half the margin to spread logins across a fleet.
+func (c *Client) RunTokenRefresher(ctx context.Context) {
+	margin := c.config.CrowdSec.TokenRefreshMargin
+	if !c.usesToken() || margin <= 0 {
+		return
+	}
+
+	c.logger.Debug("token refresher started", "margin", margin)
+	for {
+		timer := time.NewTimer(c.nextRefresh(margin))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		refreshCtx, cancel := c.RequestContext(ctx)
+		err := c.ensureToken(refreshCtx, true)
+		cancel()
+		if err != nil {
+			c.logger.Warn("background token refresh failed", "error", err, "retry_in", refreshRetryInterval)
+			timer := time.NewTimer(refreshRetryInterval)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			continue
+		}
+		c.logger.Debug("token refreshed", "expire", c.Expire())
+	}
+}
+
+// nextRefresh returns how long to wait before renewing the current token.
+// Without a token it logs in immediately; tokens shorter lived than the margin
+// are renewed no more often than refreshRetryInterval.
+func (c *Client) nextRefresh(margin time.Duration) time.Duration {
+	if c.Token() == "" {
+		return 0
+	}
+
+	jitter := time.Duration(rand.Int64N(int64(margin/2) + 1))
+	wait := time.Until(c.Expire()) - margin - jitter
+	if wait < refreshRetryInterval {
+		return refreshRetryInterval
+	}
+	return wait
+}
@@ -0,0 +1,117 @@
+package crowdsec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestNextRefresh ensures renewals happen a jittered margin ahead of expiry, never more often than the retry interval.
+func TestNextRefresh(t *testing.T) {
+	const margin = 10 * time.Minute
+	c := newTestClient(t, func(req *http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("unexpected request: %s", req.URL.Path)
+	})
+
+	if got := c.nextRefresh(margin); got != 0 {
+		t.Fatalf("expected an immediate login without a token, got %s", got)
+	}
+
+	c.setToken("token", time.Now().Add(time.Hour))
+	for range 100 {
+		got := c.nextRefresh(margin)
+		// Bounds are widened by a second for the time elapsed since setToken
+		if got > time.Hour-margin || got < time.Hour-margin-margin/2-time.Second {
+			t.Fatalf("expected a renewal between 45m and 50m before expiry, got %s", got)
+		}
+	}
+
+	c.setToken("token", time.Now().Add(margin))
+	if got := c.nextRefresh(margin); got != refreshRetryInterval {
+		t.Fatalf("expected a token shorter lived than the margin to wait %s, got %s", refreshRetryInterval, got)
+	}
+}
+
+// TestRefreshKeepsTokenInUse ensures scrapes keep using the current token while a forced login is in flight.
+func TestRefreshKeepsTokenInUse(t *testing.T) {
+	loginStarted := make(chan struct{})
+	releaseLogin := make(chan struct{})
+	used := make(chan string, 1)
+
+	c := newTestClient(t, func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/v1/watchers/login":
+			close(loginStarted)
+			<-releaseLogin
+			payload := fmt.Sprintf(`{"token":"new-token","expire":"%s"}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+			return newResponse(http.StatusOK, payload), nil
+		case "/v1/alerts":
+			used <- req.Header.Get("Authorization")
+			return newResponse(http.StatusOK, `[]`), nil
+		default:
+			return nil, fmt.Errorf("unexpected path: %s", req.URL.Path)
+		}
+	})
+	c.setToken("old-token", time.Now().Add(time.Hour))
+
+	refreshed := make(chan error, 1)
+	go func() { refreshed <- c.ensureToken(context.Background(), true) }()
+	<-loginStarted
+
+	if _, _, err := c.QueryAlerts(context.Background(), 0); err != nil {
+		t.Fatalf("query alerts: %v", err)
+	}
+	if got := <-used; got != "Bearer old-token" {
+		t.Fatalf("expected the scrape to use the old token during the refresh, got %q", got)
+	}
+
+	close(releaseLogin)
+	if err := <-refreshed; err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if got := c.Token(); got != "new-token" {
+		t.Fatalf("expected the refreshed token, got %q", got)
+	}
+}
+
+// TestLoginWaitHonoursDeadline ensures a scrape needing a new token gives up at its
+// deadline instead of waiting on a hung login already in flight.
+func TestLoginWaitHonoursDeadline(t *testing.T) {
+	loginStarted := make(chan struct{})
+	releaseLogin := make(chan struct{})
+
+	c := newTestClient(t, func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/v1/watchers/login":
+			close(loginStarted)
+			<-releaseLogin
+			return nil, fmt.Errorf("login abandoned")
+		default:
+			return nil, fmt.Errorf("unexpected path: %s", req.URL.Path)
+		}
+	})
+	c.setToken("expired-token", time.Now())
+
+	refreshed := make(chan error, 1)
+	go func() { refreshed <- c.ensureToken(context.Background(), true) }()
+	<-loginStarted
+	defer func() {
+		close(releaseLogin)
+		<-refreshed
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, _, err := c.QueryAlerts(ctx, 0)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to end the wait for the login, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("expected the scrape to return at its 100ms deadline, took %s", elapsed)
+	}
+}
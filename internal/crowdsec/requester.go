@@ -1,160 +1,308 @@
 package crowdsec
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/hydazz/crowdsec-exporter/internal/config"
 	"github.com/hydazz/crowdsec-exporter/internal/models"
 )
 
-func QueryAlerts(limit int64, retry int) (models.Alerts, error) {
-	if err := CheckAuth(); err != nil {
-		return nil, fmt.Errorf("check auth: %w", err)
+// QueryAlerts fetches alerts and their decisions from LAPI using the configured
+// filters, paging through every result up to crowdsec.max_results. Each origin
+// needs its own requests; alerts are merged by ID. truncated reports whether
+// alerts were left unread.
+func (c *Client) QueryAlerts(ctx context.Context, retry int) (alerts models.Alerts, truncated bool, err error) {
+	cfg := c.config.CrowdSec
+
+	pageSize := cfg.PageSize
+	if pageSize <= 0 {
+		pageSize = config.DefaultPageSize
 	}
 
-	var (
-		res *http.Response
-		err error
-	)
-	url := fmt.Sprintf("%s/v1/alerts?limit=%d&origin=crowdsec", AuthToken.Config.CrowdSec.URL, limit)
+	origins := cfg.Alerts.Origins
+	if len(origins) == 0 || slices.Equal(origins, []string{config.AnyOrigin}) {
+		// An empty origin sends no filter
+		origins = []string{""}
+	}
 
-	for attempts := retry; attempts >= 0; attempts-- {
-		req, rerr := http.NewRequest("GET", url, nil)
-		if rerr != nil {
-			return nil, rerr
-		}
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "Bearer "+GetToken())
+	seen := make(map[int64]bool)
+	for _, origin := range origins {
+		limit := pageSize
+		query := alertsQuery(cfg.Alerts, origin, limit)
+		for {
+			page, lapiNow, err := c.queryAlerts(ctx, query, retry)
+			if err != nil {
+				return nil, false, err
+			}
 
-		res, err = http.DefaultClient.Do(req)
-		if err != nil {
-			if attempts == 0 {
-				return nil, err
+			added := 0
+			var oldest time.Time
+			for _, v := range page {
+				if created, err := time.Parse(time.RFC3339, v.CreatedAt); err == nil && (oldest.IsZero() || created.Before(oldest)) {
+					oldest = created
+				}
+				if v.ID != 0 && seen[v.ID] {
+					continue
+				}
+				if cfg.MaxResults > 0 && len(alerts) >= cfg.MaxResults {
+					return alerts, true, nil
+				}
+				seen[v.ID] = true
+				alerts = append(alerts, toAlert(v))
+				added++
 			}
-			continue
-		}
-		if res.StatusCode >= 300 {
-			res.Body.Close()
-			if attempts == 0 {
-				return nil, fmt.Errorf("%s", res.Status)
+
+			if len(page) < limit {
+				break
+			}
+			if oldest.IsZero() {
+				c.logger.Warn("cannot page through alerts without a creation time", "origin", origin)
+				truncated = true
+				break
 			}
-			continue
+
+			// A page holding only alerts already read means more alerts share the oldest
+			// second than fit in a page: widen the page until it reaches past them
+			if added == 0 {
+				limit *= 2
+			} else {
+				limit = pageSize
+			}
+			query.Set("limit", strconv.Itoa(limit))
+
+			// LAPI has no offset, so continue from the oldest alert seen. created_before is
+			// relative to LAPI's clock, read from the Date header, and created_at is rounded
+			// down to the second like the header. Reaching one second past oldest keeps the
+			// alerts of that second not read yet; the overlap is deduplicated by ID.
+			query.Set("created_before", max(lapiNow.Sub(oldest)-time.Second, 0).String())
 		}
-		break
 	}
 
-	if res == nil {
-		return nil, errors.New("no response received from CrowdSec")
+	return alerts, truncated, nil
+}
+
+// queryAlerts fetches one page of alerts along with LAPI's current time
+func (c *Client) queryAlerts(ctx context.Context, query url.Values, retry int) ([]lapiAlert, time.Time, error) {
+	res, err := c.get(ctx, c.baseURL+"/v1/alerts?"+query.Encode(), retry)
+	if err != nil {
+		return nil, time.Time{}, err
 	}
 	defer res.Body.Close()
 
-	var raw []map[string]interface{}
+	lapiNow, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		lapiNow = time.Now()
+	}
+
+	var raw []lapiAlert
 	if err := json.NewDecoder(res.Body).Decode(&raw); err != nil {
-		return nil, err
-	}
-
-	var alerts models.Alerts
-	for _, v := range raw {
-		var a models.Alert
-		a.Scenario = getString(v, "scenario")
-		a.DateTime = getString(v, "created_at")
-		a.CreatedAt = getString(v, "created_at")
-		a.StartAt = getString(v, "start_at")
-		a.StopAt = getString(v, "stop_at")
-
-		if src, ok := v["source"].(map[string]interface{}); ok {
-			a.IPAddress = getString(src, "ip")
-			a.Latitude = getFloat(src, "latitude")
-			a.Longitude = getFloat(src, "longitude")
-			a.Country = getString(src, "cn")
-			if r := getString(src, "range"); r != "" {
-				a.Subnet = r
-				a.IPRange = r
-			}
-			a.AsName = getString(src, "as_name")
-			a.AsNumber = getString(src, "as_number")
-		}
+		return nil, time.Time{}, fmt.Errorf("decode alerts: %w", err)
+	}
+	return raw, lapiNow, nil
+}
 
-		if ds, ok := v["decisions"].([]interface{}); ok {
-			for _, d := range ds {
-				if dm, ok := d.(map[string]interface{}); ok {
-					var dec models.Decision
-					dec.ID = getInt(dm, "id")
-					dec.UUID = getString(dm, "uuid")
-					dec.Scenario = getString(dm, "scenario")
-					dec.IPAddress = getString(dm, "value")
-					dec.Type = getString(dm, "type")
-					dec.Scope = getString(dm, "scope")
-
-					// Calculate original duration because CrowdSec API provides duration as remainder?
-					remainingDuration := getString(dm, "duration")
-					dec.Duration = calculateOriginalDuration(a.CreatedAt, remainingDuration)
-
-					dec.Country = a.Country
-					dec.AsName = a.AsName
-					dec.AsNumber = a.AsNumber
-					dec.Latitude = a.Latitude
-					dec.Longitude = a.Longitude
-					dec.IPRange = a.IPRange
-
-					a.Decisions = append(a.Decisions, dec)
-				}
-			}
+// alertsQuery maps the configured filters to /v1/alerts query parameters
+func alertsQuery(f config.AlertsConfig, origin string, limit int) url.Values {
+	q := url.Values{}
+	q.Set("limit", strconv.Itoa(limit))
+
+	set := func(key, value string) {
+		if value != "" {
+			q.Set(key, value)
 		}
+	}
+	set("origin", origin)
+	set("scenario", f.Scenario)
+	set("scope", f.Scope)
+	set("value", f.Value)
+	set("range", f.Range)
+	set("decision_type", f.DecisionType)
+	if f.Since > 0 {
+		q.Set("since", f.Since.String())
+	}
+	if f.Until > 0 {
+		q.Set("until", f.Until.String())
+	}
+	if f.HasActiveDecision {
+		q.Set("has_active_decision", "true")
+	}
+	if f.IncludeCAPI {
+		q.Set("include_capi", "true")
+	}
+	if f.Simulated {
+		q.Set("simulated", "true")
+	}
+	return q
+}
 
-		alerts = append(alerts, a)
+// toAlert converts a decoded LAPI alert, copying source details onto each decision
+func toAlert(v lapiAlert) models.Alert {
+	a := models.Alert{
+		ID:              v.ID,
+		UUID:            v.UUID,
+		MachineID:       v.MachineID,
+		Scenario:        v.Scenario,
+		ScenarioHash:    v.ScenarioHash,
+		ScenarioVersion: v.ScenarioVersion,
+		Message:         v.Message,
+		EventsCount:     v.EventsCount,
+		Capacity:        v.Capacity,
+		Leakspeed:       v.Leakspeed,
+		Simulated:       v.Simulated,
+		Remediation:     v.Remediation,
+		Labels:          v.Labels,
+		DateTime:        v.CreatedAt,
+		CreatedAt:       v.CreatedAt,
+		StartAt:         v.StartAt,
+		StopAt:          v.StopAt,
 	}
 
-	return alerts, nil
-}
+	a.Meta = toMeta(v.Meta)
+	for _, e := range v.Events {
+		a.Events = append(a.Events, models.Event{Timestamp: e.Timestamp, Meta: toMeta(e.Meta)})
+	}
 
-func getString(m map[string]interface{}, key string) string {
-	if v, ok := m[key].(string); ok {
-		return v
+	if src := v.Source; src != nil {
+		a.SourceScope = src.Scope
+		a.SourceValue = src.Value
+		a.IPAddress = src.IP
+		a.Latitude = src.Latitude
+		a.Longitude = src.Longitude
+		a.Country = src.Country
+		a.Subnet = src.Range
+		a.IPRange = src.Range
+		a.AsName = src.AsName
+		a.AsNumber = src.AsNumber
 	}
-	return ""
-}
 
-func getFloat(m map[string]interface{}, key string) float64 {
-	if v, ok := m[key].(float64); ok {
-		return v
+	for _, d := range v.Decisions {
+		until := decisionUntil(d.Until, d.Duration)
+		a.Decisions = append(a.Decisions, models.Decision{
+			ID:        d.ID,
+			UUID:      d.UUID,
+			Scenario:  d.Scenario,
+			IPAddress: d.Value,
+			Type:      d.Type,
+			Scope:     d.Scope,
+			Origin:    d.Origin,
+			MachineID: a.MachineID,
+			Simulated: d.Simulated,
+			Until:     until,
+			// Decisions are created together with their alert
+			CreatedAt: a.CreatedAt,
+			// Only an until reported by LAPI is fixed, one derived from the remaining duration drifts
+			Duration:  originalDuration(a.CreatedAt, d.Until),
+			Country:   a.Country,
+			AsName:    a.AsName,
+			AsNumber:  a.AsNumber,
+			Latitude:  a.Latitude,
+			Longitude: a.Longitude,
+			IPRange:   a.IPRange,
+		})
 	}
-	return 0
+
+	return a
 }
 
-func getInt(m map[string]interface{}, key string) int {
-	if v, ok := m[key].(float64); ok {
-		return int(v)
+func toMeta(raw []lapiMetaItem) []models.MetaItem {
+	if len(raw) == 0 {
+		return nil
 	}
-	if v, ok := m[key].(int); ok {
-		return v
+	meta := make([]models.MetaItem, 0, len(raw))
+	for _, m := range raw {
+		meta = append(meta, models.MetaItem{Key: m.Key, Value: m.Value})
 	}
-	return 0
+	return meta
 }
 
-func calculateOriginalDuration(alertCreatedAt, remainingDuration string) string {
-	if alertCreatedAt == "" || remainingDuration == "" {
-		return ""
+// get performs an authenticated GET against LAPI, retrying network errors, 429
+// and 5xx responses up to retry times with backoff. Other failing statuses are
+// returned as an *APIError. The caller owns the returned response body.
+func (c *Client) get(ctx context.Context, rawURL string, retry int) (*http.Response, error) {
+	if err := c.CheckAuth(ctx); err != nil {
+		return nil, &AuthError{Err: err}
 	}
 
-	remaining, err := time.ParseDuration(remainingDuration)
+	endpoint := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		endpoint = route(u.Path)
+	}
+
+	reauthenticated := false
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		c.authorize(req)
+
+		res, err := c.do(req)
+		if err == nil {
+			// LAPI may restart or rotate its JWT secret before our token expires;
+			// log in again once and replay without consuming the retry budget
+			if res.StatusCode == http.StatusUnauthorized && c.usesToken() && !reauthenticated {
+				res.Body.Close()
+				reauthenticated = true
+				c.invalidateToken(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+				if err := c.CheckAuth(ctx); err != nil {
+					return nil, &AuthError{Err: err}
+				}
+				attempt--
+				continue
+			}
+			if res.StatusCode < 300 {
+				return res, nil
+			}
+			err = newAPIError(endpoint, res)
+		}
+
+		if attempt >= retry || !retryable(ctx, err) {
+			return nil, err
+		}
+
+		delay := c.retryDelay(attempt, err)
+		c.requests.recordRetry(endpoint)
+		c.logger.Debug("retrying LAPI request", "endpoint", endpoint, "attempt", attempt+1, "delay", delay, "error", err)
+		if sleepContext(ctx, delay) != nil {
+			return nil, err
+		}
+	}
+}
+
+// decisionUntil returns the decision's expiry. LAPI versions that omit until
+// only report the remaining duration, which is counted from now and rounded to
+// the minute so the derived expiry stays the same from one scrape to the next.
+func decisionUntil(until, remaining string) string {
+	if until != "" {
+		return until
+	}
+	d, err := time.ParseDuration(remaining)
 	if err != nil {
 		return ""
 	}
+	return time.Now().UTC().Add(d).Round(time.Minute).Format(time.RFC3339)
+}
 
-	alertTime, err := time.Parse(time.RFC3339, alertCreatedAt)
+// originalDuration returns the full length of a decision, from its creation to
+// its expiry. Both are fixed, so the result stays the same for the decision's lifetime.
+func originalDuration(createdAt, until string) string {
+	created, err := time.Parse(time.RFC3339, createdAt)
 	if err != nil {
 		return ""
 	}
-
-	now := time.Now()
-	elapsed := now.Sub(alertTime)
-	originalDuration := remaining + elapsed
-
-	// Round to nearest minute to avoid duplicate metrics
-	// Could be flaky, but better than nothing
-	return originalDuration.Round(time.Minute).String()
+	expiry, err := time.Parse(time.RFC3339, until)
+	if err != nil || !expiry.After(created) {
+		return ""
+	}
+	// LAPI stamps the alert and its decisions moments apart, the fraction is noise
+	return expiry.Sub(created).Round(time.Second).String()
 }
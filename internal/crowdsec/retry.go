@@ -0,0 +1,115 @@
+package crowdsec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRetryBackoff caps the exponential delay between retries
+const maxRetryBackoff = 30 * time.Second
+
+// bodyExcerptSize bounds how much of an error response is kept in APIError
+const bodyExcerptSize = 512
+
+// APIError is returned when LAPI answers a request with an unexpected status
+type APIError struct {
+	Endpoint   string
+	StatusCode int
+	// Body is the start of the response body, which usually holds LAPI's message
+	Body string
+	// RetryAfter is the delay LAPI asked for on 429 and 503 responses
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%s: %d %s", e.Endpoint, e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+// Temporary reports whether the request may succeed when retried
+func (e *APIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// newAPIError builds an APIError from res and closes its body
+func newAPIError(endpoint string, res *http.Response) *APIError {
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, bodyExcerptSize))
+
+	return &APIError{
+		Endpoint:   endpoint,
+		StatusCode: res.StatusCode,
+		Body:       strings.TrimSpace(string(body)),
+		RetryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+	}
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// retryable reports whether a failed request is worth retrying: network errors,
+// 429 and 5xx responses are, other statuses and cancellations are not
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	return true
+}
+
+// retryDelay returns how long to wait before retry number attempt (from 0),
+// honouring Retry-After and otherwise doubling crowdsec.retry_backoff with jitter
+func (c *Client) retryDelay(attempt int, err error) time.Duration {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return apiErr.RetryAfter
+	}
+
+	base := c.config.CrowdSec.RetryBackoff
+	if base <= 0 {
+		return 0
+	}
+	delay := base
+	for i := 0; i < attempt && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxRetryBackoff)
+	// Keep at least half the delay so retries from a fleet spread out without bunching at zero
+	return delay/2 + time.Duration(rand.Int64N(int64(delay/2)+1))
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
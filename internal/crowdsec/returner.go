@@ -1,14 +1,20 @@
 package crowdsec
 
 import (
+	"context"
+
 	"github.com/hydazz/crowdsec-exporter/internal/models"
 )
 
-func ReturnAlerts(limit int64) (models.Alerts, error) {
-	alerts, err := QueryAlerts(limit, 5)
+func (c *Client) ReturnAlerts(ctx context.Context) (models.Alerts, bool, error) {
+	alerts, truncated, err := c.QueryAlerts(ctx, c.config.CrowdSec.Retries)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	} else {
-		return alerts, nil
+		return alerts, truncated, nil
 	}
 }
+
+func (c *Client) ReturnDecisions(ctx context.Context) (models.DecisionArray, bool, error) {
+	return c.QueryDecisions(ctx, c.config.CrowdSec.Retries)
+}
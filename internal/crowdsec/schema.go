@@ -0,0 +1,68 @@
+package crowdsec
+
+// The types below mirror the LAPI swagger models so responses decode strictly:
+// a field of the wrong type fails the decode instead of silently becoming zero.
+
+// lapiAlert mirrors models.Alert returned by /v1/alerts
+type lapiAlert struct {
+	ID              int64          `json:"id"`
+	UUID            string         `json:"uuid"`
+	MachineID       string         `json:"machine_id"`
+	Scenario        string         `json:"scenario"`
+	ScenarioHash    string         `json:"scenario_hash"`
+	ScenarioVersion string         `json:"scenario_version"`
+	Message         string         `json:"message"`
+	EventsCount     int32          `json:"events_count"`
+	Capacity        int32          `json:"capacity"`
+	Leakspeed       string         `json:"leakspeed"`
+	Simulated       bool           `json:"simulated"`
+	Remediation     bool           `json:"remediation"`
+	Labels          []string       `json:"labels"`
+	CreatedAt       string         `json:"created_at"`
+	StartAt         string         `json:"start_at"`
+	StopAt          string         `json:"stop_at"`
+	Source          *lapiSource    `json:"source"`
+	Meta            []lapiMetaItem `json:"meta"`
+	Events          []lapiEvent    `json:"events"`
+	Decisions       []lapiDecision `json:"decisions"`
+}
+
+// lapiSource mirrors models.Source, the attacker an alert is about
+type lapiSource struct {
+	Scope    string `json:"scope"`
+	Value    string `json:"value"`
+	IP       string `json:"ip"`
+	Range    string `json:"range"`
+	AsName   string `json:"as_name"`
+	AsNumber string `json:"as_number"`
+	Country  string `json:"cn"`
+	// float32 in the swagger, decoded as float64 so coordinates format without rounding noise
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// lapiEvent mirrors models.Event, one of the log lines that triggered an alert
+type lapiEvent struct {
+	Timestamp string         `json:"timestamp"`
+	Meta      []lapiMetaItem `json:"meta"`
+}
+
+// lapiMetaItem mirrors the key/value pairs of models.Meta
+type lapiMetaItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// lapiDecision mirrors models.Decision, as embedded in alerts and returned by the bouncer endpoints
+type lapiDecision struct {
+	ID        int    `json:"id"`
+	UUID      string `json:"uuid"`
+	Origin    string `json:"origin"`
+	Type      string `json:"type"`
+	Scope     string `json:"scope"`
+	Value     string `json:"value"`
+	Duration  string `json:"duration"`
+	Until     string `json:"until"`
+	Scenario  string `json:"scenario"`
+	Simulated bool   `json:"simulated"`
+}
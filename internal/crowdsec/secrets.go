@@ -0,0 +1,95 @@
+package crowdsec
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// secretPollInterval is how often mounted secret files are checked for rotation
+const secretPollInterval = 30 * time.Second
+
+// loadSecrets reads password_file and registration_token_file into the client.
+// It reports whether the password differs from the one currently in use.
+func (c *Client) loadSecrets() (passwordChanged bool, err error) {
+	cfg := c.config.CrowdSec
+
+	var password, token string
+	if cfg.PasswordFile != "" {
+		if password, err = readSecretFile(cfg.PasswordFile); err != nil {
+			return false, fmt.Errorf("read password file: %w", err)
+		}
+	}
+	if cfg.RegistrationTokenFile != "" {
+		if token, err = readSecretFile(cfg.RegistrationTokenFile); err != nil {
+			return false, fmt.Errorf("read registration token file: %w", err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cfg.PasswordFile != "" && password != c.machinePasswd {
+		c.machinePasswd = password
+		passwordChanged = true
+	}
+	if cfg.RegistrationTokenFile != "" {
+		c.registrationToken = token
+	}
+	return passwordChanged, nil
+}
+
+// WatchSecrets re-reads the secret files until ctx is cancelled and logs in
+// again with the new password as soon as it is rotated
+func (c *Client) WatchSecrets(ctx context.Context) {
+	cfg := c.config.CrowdSec
+	if cfg.PasswordFile == "" && cfg.RegistrationTokenFile == "" {
+		return
+	}
+
+	ticker := time.NewTicker(secretPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.reloadSecrets(ctx)
+	}
+}
+
+// reloadSecrets re-reads the secret files once and logs in again if the password changed
+func (c *Client) reloadSecrets(ctx context.Context) {
+	changed, err := c.loadSecrets()
+	if err != nil {
+		c.logger.Warn("secret reload failed", "error", err)
+		return
+	}
+	if !changed || !c.usesPassword() {
+		return
+	}
+
+	c.logger.Info("password file changed, re-authenticating", "machineId", c.MachineID())
+	loginCtx, cancel := c.RequestContext(ctx)
+	defer cancel()
+	if err := c.ensureToken(loginCtx, true); err != nil {
+		c.logger.Warn("re-authentication with rotated password failed", "error", err)
+	}
+}
+
+// readSecretFile returns the file content without the trailing newline most secret tooling adds
+func readSecretFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(b))
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return secret, nil
+}
@@ -0,0 +1,91 @@
+package crowdsec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hydazz/crowdsec-exporter/internal/config"
+)
+
+// TestPasswordRotation ensures the password file is read at startup and a rotated password is used to log in again.
+func TestPasswordRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(path, []byte("first\n"), 0o600); err != nil {
+		t.Fatalf("write password file: %v", err)
+	}
+
+	var passwords []string
+	cfg := &config.Config{
+		CrowdSec: config.CrowdSecConfig{
+			URL:          "http://crowdsec.local",
+			Login:        "machine",
+			PasswordFile: path,
+		},
+	}
+	c, err := NewClient(cfg, WithHTTPClient(&http.Client{Transport: roundTripper(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/v1/watchers/login" {
+			return nil, fmt.Errorf("unexpected path: %s", req.URL.Path)
+		}
+		var body struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		passwords = append(passwords, body.Password)
+		payload := fmt.Sprintf(`{"token":"token-%d","expire":"%s"}`, len(passwords), time.Now().Add(time.Hour).Format(time.RFC3339))
+		return newResponse(http.StatusOK, payload), nil
+	})}))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	if err := c.CheckAuth(context.Background()); err != nil {
+		t.Fatalf("check auth: %v", err)
+	}
+
+	// An unchanged file must not trigger a login
+	c.reloadSecrets(context.Background())
+	if len(passwords) != 1 {
+		t.Fatalf("expected no login while the password is unchanged, got %v", passwords)
+	}
+
+	if err := os.WriteFile(path, []byte("second\n"), 0o600); err != nil {
+		t.Fatalf("rewrite password file: %v", err)
+	}
+	c.reloadSecrets(context.Background())
+
+	if want := []string{"first", "second"}; len(passwords) != 2 || passwords[0] != want[0] || passwords[1] != want[1] {
+		t.Fatalf("expected logins with %v, got %v", want, passwords)
+	}
+	if got := c.Token(); got != "token-2" {
+		t.Fatalf("expected the token from the re-login, got %q", got)
+	}
+}
+
+// TestLoadSecretsErrors ensures missing or empty secret files fail client creation.
+func TestLoadSecretsErrors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty")
+	if err := os.WriteFile(empty, []byte("\n"), 0o600); err != nil {
+		t.Fatalf("write empty file: %v", err)
+	}
+
+	for name, path := range map[string]string{
+		"missing": filepath.Join(dir, "missing"),
+		"empty":   empty,
+	} {
+		cfg := &config.Config{
+			CrowdSec: config.CrowdSecConfig{URL: "http://crowdsec.local", Login: "machine", PasswordFile: path},
+		}
+		if _, err := NewClient(cfg); err == nil {
+			t.Errorf("%s: expected an error reading the password file", name)
+		}
+	}
+}
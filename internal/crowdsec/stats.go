@@ -0,0 +1,110 @@
+package crowdsec
+
+import (
+	"sync"
+	"time"
+)
+
+// Reasons a login against /v1/watchers/login can fail
+const (
+	LoginFailureBadCredentials = "bad_credentials"
+	LoginFailureNetwork        = "network"
+	LoginFailureDecode         = "decode"
+	LoginFailureStatus         = "unexpected_status"
+)
+
+// LoginFailureReasons lists every reason reported in AuthStats.LoginFailures
+var LoginFailureReasons = []string{
+	LoginFailureBadCredentials,
+	LoginFailureNetwork,
+	LoginFailureDecode,
+	LoginFailureStatus,
+}
+
+// AuthStats is a snapshot of the client's authentication health
+type AuthStats struct {
+	TokenExpire   time.Time
+	LastLogin     time.Time
+	Registered    bool
+	LoginAttempts uint64
+	LoginFailures map[string]uint64
+	ForcedReauths uint64
+}
+
+// authStats accumulates authentication counters
+type authStats struct {
+	mu            sync.Mutex
+	lastLogin     time.Time
+	loginAttempts uint64
+	loginFailures map[string]uint64
+	forcedReauths uint64
+}
+
+// recordLogin counts a login attempt, failed with reason unless reason is empty
+func (s *authStats) recordLogin(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.loginAttempts++
+	if reason == "" {
+		s.lastLogin = time.Now()
+		return
+	}
+	if s.loginFailures == nil {
+		s.loginFailures = make(map[string]uint64)
+	}
+	s.loginFailures[reason]++
+}
+
+func (s *authStats) recordForcedReauth() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forcedReauths++
+}
+
+// AuthStats returns the current authentication health of the client
+func (c *Client) AuthStats() AuthStats {
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+
+	failures := make(map[string]uint64, len(LoginFailureReasons))
+	for _, reason := range LoginFailureReasons {
+		failures[reason] = c.stats.loginFailures[reason]
+	}
+
+	return AuthStats{
+		TokenExpire:   c.Expire(),
+		LastLogin:     c.stats.lastLogin,
+		Registered:    c.isRegistered.Load(),
+		LoginAttempts: c.stats.loginAttempts,
+		LoginFailures: failures,
+		ForcedReauths: c.stats.forcedReauths,
+	}
+}
+
+// requestStats counts retried LAPI requests by endpoint
+type requestStats struct {
+	mu      sync.Mutex
+	retries map[string]uint64
+}
+
+func (s *requestStats) recordRetry(endpoint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.retries == nil {
+		s.retries = make(map[string]uint64)
+	}
+	s.retries[endpoint]++
+}
+
+// RetryStats returns how many LAPI requests were retried, by endpoint route
+func (c *Client) RetryStats() map[string]uint64 {
+	c.requests.mu.Lock()
+	defer c.requests.mu.Unlock()
+
+	retries := make(map[string]uint64, len(c.requests.retries))
+	for endpoint, count := range c.requests.retries {
+		retries[endpoint] = count
+	}
+	return retries
+}
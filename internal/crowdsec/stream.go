@@ -0,0 +1,99 @@
+package crowdsec
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hydazz/crowdsec-exporter/internal/models"
+)
+
+// decisionSet holds the active decisions built from /v1/decisions/stream
+type decisionSet struct {
+	mu        sync.RWMutex
+	decisions map[int]models.Decision
+	synced    bool
+}
+
+// RunDecisionStream polls /v1/decisions/stream every stream interval until ctx is
+// cancelled. The first poll downloads every active decision and later polls only
+// the decisions added or deleted since, so scrapes cost no LAPI traffic.
+func (c *Client) RunDecisionStream(ctx context.Context) {
+	stream := c.config.CrowdSec.Stream
+	if !stream.Enabled {
+		return
+	}
+
+	c.logger.Debug("decision stream started", "interval", stream.Interval)
+	startup := true
+	for {
+		pollCtx, cancel := c.RequestContext(ctx)
+		err := c.pollDecisionStream(pollCtx, startup)
+		cancel()
+		if err != nil {
+			// LAPI tracks the last successful pull, so the next poll catches up
+			c.logger.Warn("decision stream poll failed", "error", err, "retry_in", stream.Interval)
+		} else {
+			startup = false
+		}
+
+		timer := time.NewTimer(stream.Interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// pollDecisionStream applies one stream response, replacing the set on startup
+func (c *Client) pollDecisionStream(ctx context.Context, startup bool) error {
+	added, deleted, err := c.StreamDecisions(ctx, startup, c.config.CrowdSec.Retries)
+	if err != nil {
+		return err
+	}
+
+	s := &c.stream
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if startup || s.decisions == nil {
+		s.decisions = make(map[int]models.Decision, len(added))
+	}
+	for _, d := range deleted {
+		delete(s.decisions, d.ID)
+	}
+	for _, d := range added {
+		s.decisions[d.ID] = d
+	}
+	s.synced = true
+
+	c.logger.Debug("decision stream polled", "added", len(added), "deleted", len(deleted), "active", len(s.decisions))
+	return nil
+}
+
+// StreamedDecisions returns the decisions currently held from the stream, ordered
+// by ID. ok is false until the first poll has succeeded.
+func (c *Client) StreamedDecisions() (decisions models.DecisionArray, ok bool) {
+	s := &c.stream
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.synced {
+		return nil, false
+	}
+
+	now := time.Now()
+	decisions = make(models.DecisionArray, 0, len(s.decisions))
+	for _, d := range s.decisions {
+		// Expiries are only reported on the next poll, drop them in between
+		if until, err := time.Parse(time.RFC3339, d.Until); err == nil && until.Before(now) {
+			continue
+		}
+		decisions = append(decisions, d)
+	}
+	sort.Slice(decisions, func(i, j int) bool { return decisions[i].ID < decisions[j].ID })
+	return decisions, true
+}
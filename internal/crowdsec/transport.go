@@ -0,0 +1,158 @@
+package crowdsec
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/hydazz/crowdsec-exporter/internal/config"
+)
+
+// unixBaseURL stands in for the LAPI address when dialing a Unix socket
+const unixBaseURL = "http://localhost"
+
+// newHTTPClient builds the HTTP client used for LAPI requests
+func newHTTPClient(cfg config.CrowdSecConfig) (*http.Client, error) {
+	tlsConfig, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	switch socket, isUnix := unixSocketPath(cfg.URL); {
+	case isUnix:
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+	case cfg.Proxy.URL != "":
+		proxyURL, err := url.Parse(cfg.Proxy.URL)
+		if err != nil {
+			return nil, fmt.Errorf("parse proxy url: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	default:
+		// DefaultTransport already honours HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	}
+
+	// no_proxy applies to the configured proxy and to one taken from the environment
+	if noProxy := splitNoProxy(cfg.Proxy.NoProxy); len(noProxy) > 0 && transport.Proxy != nil {
+		proxy := transport.Proxy
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if bypassProxy(req.URL.Hostname(), noProxy) {
+				return nil, nil
+			}
+			return proxy(req)
+		}
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// baseURL returns the address LAPI paths are appended to
+func baseURL(raw string) string {
+	if _, isUnix := unixSocketPath(raw); isUnix {
+		return unixBaseURL
+	}
+	return strings.TrimRight(raw, "/")
+}
+
+// unixSocketPath extracts the socket path from a unix:///path/to/socket URL
+func unixSocketPath(raw string) (string, bool) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "unix" {
+		return "", false
+	}
+	return u.Path, true
+}
+
+// splitNoProxy parses a comma-separated NO_PROXY style list
+func splitNoProxy(list string) []string {
+	var rules []string
+	for _, rule := range strings.Split(list, ",") {
+		if rule = strings.ToLower(strings.TrimSpace(rule)); rule != "" {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// bypassProxy reports whether host matches a no_proxy rule. Rules are "*", IPs,
+// CIDR ranges, or domains; "example.com" also matches its subdomains while
+// ".example.com" matches only subdomains.
+func bypassProxy(host string, rules []string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, rule := range rules {
+		if rule == "*" {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(rule); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if ruleIP := net.ParseIP(rule); ruleIP != nil {
+			if ip != nil && ruleIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		if strings.HasPrefix(rule, ".") {
+			if strings.HasSuffix(host, rule) {
+				return true
+			}
+			continue
+		}
+		if host == rule || strings.HasSuffix(host, "."+rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// newTLSConfig returns nil when no TLS settings are configured
+func newTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	if cfg == (config.TLSConfig{}) {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         cfg.MinTLSVersion(),
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
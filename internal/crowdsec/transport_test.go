@@ -0,0 +1,201 @@
+package crowdsec
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hydazz/crowdsec-exporter/internal/config"
+)
+
+// TestBypassProxy ensures no_proxy rules follow the usual NO_PROXY conventions.
+func TestBypassProxy(t *testing.T) {
+	rules := splitNoProxy(" lapi.internal, .corp.example ,10.0.0.0/8,192.168.1.5")
+
+	tests := map[string]bool{
+		"lapi.internal":         true,
+		"eu.lapi.internal":      true,
+		"corp.example":          false,
+		"crowdsec.corp.example": true,
+		"10.1.2.3":              true,
+		"192.168.1.5":           true,
+		"192.168.1.6":           false,
+		"crowdsec.net":          false,
+	}
+	for host, want := range tests {
+		if got := bypassProxy(host, rules); got != want {
+			t.Errorf("bypassProxy(%q) = %v, want %v", host, got, want)
+		}
+	}
+
+	if !bypassProxy("anything", splitNoProxy("*")) {
+		t.Errorf("expected * to bypass every host")
+	}
+}
+
+// TestProxySelection ensures no_proxy applies to the configured proxy and to one taken from the environment.
+func TestProxySelection(t *testing.T) {
+	proxyFor := func(t *testing.T, cfg config.CrowdSecConfig, target string) string {
+		t.Helper()
+		hc, err := newHTTPClient(cfg)
+		if err != nil {
+			t.Fatalf("http client: %v", err)
+		}
+		proxy, err := hc.Transport.(*http.Transport).Proxy(httptest.NewRequest(http.MethodGet, target, nil))
+		if err != nil {
+			t.Fatalf("proxy: %v", err)
+		}
+		if proxy == nil {
+			return "direct"
+		}
+		return proxy.Host
+	}
+
+	configured := config.CrowdSecConfig{Proxy: config.ProxyConfig{URL: "http://proxy:3128", NoProxy: "lapi.internal"}}
+	if got := proxyFor(t, configured, "http://crowdsec.net/v1/alerts"); got != "proxy:3128" {
+		t.Fatalf("expected the configured proxy, got %s", got)
+	}
+	if got := proxyFor(t, configured, "http://lapi.internal/v1/alerts"); got != "direct" {
+		t.Fatalf("expected no_proxy to bypass the configured proxy, got %s", got)
+	}
+
+	// Without proxy.url the environment is consulted for hosts outside no_proxy
+	environment := config.CrowdSecConfig{Proxy: config.ProxyConfig{NoProxy: "lapi.internal"}}
+	if got := proxyFor(t, environment, "http://lapi.internal/v1/alerts"); got != "direct" {
+		t.Fatalf("expected no_proxy to bypass the environment proxy, got %s", got)
+	}
+	want := "direct"
+	if proxy, _ := http.ProxyFromEnvironment(httptest.NewRequest(http.MethodGet, "http://crowdsec.net/v1/alerts", nil)); proxy != nil {
+		want = proxy.Host
+	}
+	if got := proxyFor(t, environment, "http://crowdsec.net/v1/alerts"); got != want {
+		t.Fatalf("expected the environment proxy %s, got %s", want, got)
+	}
+}
+
+// TestUnixSocket ensures LAPI can be reached through a unix:// URL.
+func TestUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "lapi.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/decisions" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`[{"id":1,"type":"ban","scope":"Ip","value":"1.2.3.4"}]`))
+	})}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	cfg := &config.Config{
+		CrowdSec: config.CrowdSecConfig{
+			URL:    "unix://" + socket,
+			APIKey: "key",
+		},
+	}
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	decisions, _, err := c.QueryDecisions(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("query decisions: %v", err)
+	}
+	if len(decisions) != 1 || decisions[0].IPAddress != "1.2.3.4" {
+		t.Fatalf("unexpected decisions: %+v", decisions)
+	}
+}
+
+// TestTLSConfig ensures the CA bundle, server name, minimum version and insecure mode apply to LAPI connections.
+func TestTLSConfig(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	})
+	// Failed handshakes are expected, keep them out of the test output
+	quiet := log.New(io.Discard, "", 0)
+
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.ErrorLog = quiet
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	// Only allows TLS 1.2, to check the minimum version is enforced
+	tls12 := httptest.NewUnstartedServer(handler)
+	tls12.Config.ErrorLog = quiet
+	tls12.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	tls12.StartTLS()
+	t.Cleanup(tls12.Close)
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatalf("write CA bundle: %v", err)
+	}
+	emptyCA := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(emptyCA, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("write CA bundle: %v", err)
+	}
+
+	// The test certificate is issued for 127.0.0.1 and example.com, not localhost
+	localhost := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	tests := []struct {
+		name      string
+		url       string
+		tls       config.TLSConfig
+		clientErr string
+		wantErr   string
+	}{
+		{name: "CA bundle", url: server.URL, tls: config.TLSConfig{CAFile: caFile}},
+		{name: "unknown CA", url: server.URL, tls: config.TLSConfig{MinVersion: "1.2"}, wantErr: "certificate"},
+		{name: "CA bundle without certificates", url: server.URL, tls: config.TLSConfig{CAFile: emptyCA}, clientErr: "no certificates found"},
+		{name: "server name override", url: localhost, tls: config.TLSConfig{CAFile: caFile, ServerName: "example.com"}},
+		{name: "server name mismatch", url: localhost, tls: config.TLSConfig{CAFile: caFile}, wantErr: "localhost"},
+		{name: "minimum version", url: tls12.URL, tls: config.TLSConfig{InsecureSkipVerify: true, MinVersion: "1.3"}, wantErr: "protocol version"},
+		{name: "insecure", url: server.URL, tls: config.TLSConfig{InsecureSkipVerify: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				CrowdSec: config.CrowdSecConfig{URL: tt.url, APIKey: "key", TLS: tt.tls},
+			}
+			c, err := NewClient(cfg)
+			if tt.clientErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.clientErr) {
+					t.Fatalf("expected client error containing %q, got %v", tt.clientErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to create client: %v", err)
+			}
+
+			_, _, err = c.QueryDecisions(context.Background(), 0)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("query decisions: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package exporter
+
+import (
+	"time"
+
+	"github.com/hydazz/crowdsec-exporter/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// activeKey identifies one cs_lapi_decisions_active series
+type activeKey struct {
+	scenario, decisionType, origin string
+}
+
+// asnKey identifies one cs_lapi_decisions_active_by_asn series
+type asnKey struct {
+	number, name string
+}
+
+// collectAggregates counts the unexpired decisions held in snap for each enabled
+// aggregate, so dashboards need not sum one cs_lapi_decision series per IP
+func (e *Exporter) collectAggregates(ch chan<- prometheus.Metric, snap *snapshot) {
+	aggregates := e.config.Exporter.Aggregates
+	if !aggregates.Active && !aggregates.ByCountry && !aggregates.ByASN {
+		return
+	}
+
+	active := make(map[activeKey]int)
+	byCountry := make(map[string]int)
+	byASN := make(map[asnKey]int)
+	now := time.Now()
+	count := func(d models.Decision) {
+		if expired(d, now) {
+			return
+		}
+		active[activeKey{d.Scenario, d.Type, d.Origin}]++
+		byCountry[d.Country]++
+		byASN[asnKey{d.AsNumber, d.AsName}]++
+	}
+
+	for _, decision := range snap.decisions {
+		count(decision)
+	}
+	for _, alert := range snap.alerts {
+		for _, decision := range alert.Decisions {
+			count(decision)
+		}
+	}
+
+	instance := e.config.Exporter.InstanceName
+	if aggregates.Active {
+		for k, n := range active {
+			ch <- prometheus.MustNewConstMetric(e.metrics.DecisionsActive, prometheus.GaugeValue, float64(n), instance, k.scenario, k.decisionType, k.origin)
+		}
+	}
+	if aggregates.ByCountry {
+		for country, n := range byCountry {
+			ch <- prometheus.MustNewConstMetric(e.metrics.DecisionsByCountry, prometheus.GaugeValue, float64(n), instance, country)
+		}
+	}
+	if aggregates.ByASN {
+		for k, n := range byASN {
+			ch <- prometheus.MustNewConstMetric(e.metrics.DecisionsByASN, prometheus.GaugeValue, float64(n), instance, k.number, k.name)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package exporter
+
+import (
+	"maps"
+	"strconv"
+	"time"
+
+	"github.com/hydazz/crowdsec-exporter/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// alertKey identifies one cs_lapi_alerts_total series
+type alertKey struct {
+	scenario, machineID, scope string
+}
+
+// collectAlerts exports every alert, so detections are visible even when no
+// decision was taken, as with simulated scenarios or notification-only profiles
+func (e *Exporter) collectAlerts(ch chan<- prometheus.Metric, alerts models.Alerts) {
+	instance := e.config.Exporter.InstanceName
+
+	for _, alert := range alerts {
+		id := strconv.FormatInt(alert.ID, 10)
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.Alert,
+			prometheus.GaugeValue,
+			1,
+			instance,
+			id,
+			alert.Scenario,
+			alert.MachineID,
+			alert.SourceScope,
+			alert.SourceValue,
+			strconv.FormatBool(alert.Simulated),
+			strconv.FormatBool(alert.Remediation),
+		)
+		ch <- prometheus.MustNewConstMetric(e.metrics.AlertEvents, prometheus.GaugeValue, float64(alert.EventsCount), instance, id, alert.Scenario)
+		ch <- prometheus.MustNewConstMetric(e.metrics.AlertCapacity, prometheus.GaugeValue, float64(alert.Capacity), instance, id, alert.Scenario)
+
+		// Manual and CAPI alerts come from no bucket and carry no leak speed
+		if leakspeed, err := time.ParseDuration(alert.Leakspeed); err == nil {
+			ch <- prometheus.MustNewConstMetric(e.metrics.AlertLeakspeed, prometheus.GaugeValue, leakspeed.Seconds(), instance, id, alert.Scenario)
+		}
+	}
+
+	e.mu.RLock()
+	counts := maps.Clone(e.alertCounts)
+	e.mu.RUnlock()
+	for k, count := range counts {
+		ch <- prometheus.MustNewConstMetric(e.metrics.AlertsTotal, prometheus.CounterValue, float64(count), instance, k.scenario, k.machineID, k.scope)
+	}
+}
+
+// countAlerts adds the alerts not counted by a previous read to cs_lapi_alerts_total,
+// e.mu must be held. LAPI numbers alerts in creation order, so only IDs above the
+// newest one counted are new.
+func (e *Exporter) countAlerts(alerts models.Alerts) {
+	newest := e.lastAlertID
+	for _, alert := range alerts {
+		if alert.ID <= e.lastAlertID {
+			continue
+		}
+		e.alertCounts[alertKey{alert.Scenario, alert.MachineID, alert.SourceScope}]++
+		newest = max(newest, alert.ID)
+	}
+	e.lastAlertID = newest
+}
@@ -1,8 +1,10 @@
 package exporter
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"sync"
 	"time"
 
 	"github.com/hydazz/crowdsec-exporter/internal/config"
@@ -14,117 +16,425 @@ import (
 // Exporter represents the CrowdSec metrics exporter
 type Exporter struct {
 	config  *config.Config
+	client  *crowdsec.Client
 	metrics *Metrics
+
+	// mu guards the snapshot kept by RunPoller and the self-monitoring state
+	mu          sync.RWMutex
+	snapshot    *snapshot
+	pollFailed  bool
+	lastSuccess time.Time
+	fetchErrors map[string]uint64
+	// alertCounts counts each alert once, lastAlertID being the newest counted
+	alertCounts map[alertKey]uint64
+	lastAlertID int64
+	// labels extract the configured cs_lapi_decision label values
+	labels []decisionLabel
+	// requestDuration is fed by the client's request observer
+	requestDuration *prometheus.HistogramVec
 }
 
 // Metrics contains all Prometheus metrics
 type Metrics struct {
-	DecisionInfo *prometheus.Desc
+	DecisionInfo       *prometheus.Desc
+	DecisionExpiry     *prometheus.Desc
+	ForcedReauths      *prometheus.Desc
+	TokenExpiry        *prometheus.Desc
+	TokenExpirySeconds *prometheus.Desc
+	LoginAttempts      *prometheus.Desc
+	LoginFailures      *prometheus.Desc
+	LastLogin          *prometheus.Desc
+	Registered         *prometheus.Desc
+	EventMeta          *prometheus.Desc
+	Alert              *prometheus.Desc
+	AlertEvents        *prometheus.Desc
+	AlertCapacity      *prometheus.Desc
+	AlertLeakspeed     *prometheus.Desc
+	AlertsTotal        *prometheus.Desc
+	DecisionsActive    *prometheus.Desc
+	DecisionsByCountry *prometheus.Desc
+	DecisionsByASN     *prometheus.Desc
+	CapReached         *prometheus.Desc
+	RequestRetries     *prometheus.Desc
+	SnapshotAge        *prometheus.Desc
+	SnapshotStale      *prometheus.Desc
+	Up                 *prometheus.Desc
+	LastSuccess        *prometheus.Desc
+	Errors             *prometheus.Desc
+	AlertsProcessed    *prometheus.Desc
+	DecisionsProcessed *prometheus.Desc
 }
 
-// New creates a new CrowdSec exporter
-func New(cfg *config.Config) (*Exporter, error) {
-	// Initialize CrowdSec client
-	if err := initCrowdSecClient(cfg); err != nil {
+// New creates a new CrowdSec exporter that queries LAPI through client
+func New(cfg *config.Config, client *crowdsec.Client) (*Exporter, error) {
+	labelNames := cfg.Exporter.DecisionLabels
+	if len(labelNames) == 0 {
+		labelNames = config.DefaultDecisionLabels
+	}
+	labels, err := newDecisionLabels(labelNames)
+	if err != nil {
 		return nil, err
 	}
 
+	decisionLabelNames := append([]string{"instance"}, labelNames...)
 	metrics := &Metrics{
 		DecisionInfo: prometheus.NewDesc(
 			"cs_lapi_decision",
-			"CrowdSec decisions with detailed metadata",
-			[]string{
-				"instance",
-				"id",
-				"country",
-				"asname",
-				"asnumber",
-				"latitude",
-				"longitude",
-				"iprange",
-				"scenario",
-				"type",
-				"duration",
-				"scope",
-				"ip",
-			},
+			"CrowdSec decisions with detailed metadata, counting the decisions that share each label set",
+			decisionLabelNames,
+			nil,
+		),
+		DecisionExpiry: prometheus.NewDesc(
+			"cs_lapi_decision_expiry_timestamp_seconds",
+			"Unix time at which the last CrowdSec decision sharing each cs_lapi_decision label set expires",
+			decisionLabelNames,
+			nil,
+		),
+		ForcedReauths: prometheus.NewDesc(
+			"cs_lapi_forced_reauthentications_total",
+			"Number of times LAPI rejected the bearer token before its expiry",
+			[]string{"instance"},
+			nil,
+		),
+		TokenExpiry: prometheus.NewDesc(
+			"cs_lapi_token_expiry_timestamp_seconds",
+			"Unix time at which the current LAPI token expires",
+			[]string{"instance"},
+			nil,
+		),
+		TokenExpirySeconds: prometheus.NewDesc(
+			"cs_lapi_token_expiry_seconds",
+			"Seconds until the current LAPI token expires, negative once expired",
+			[]string{"instance"},
+			nil,
+		),
+		LoginAttempts: prometheus.NewDesc(
+			"cs_lapi_login_attempts_total",
+			"Number of logins attempted against LAPI",
+			[]string{"instance"},
+			nil,
+		),
+		LoginFailures: prometheus.NewDesc(
+			"cs_lapi_login_failures_total",
+			"Number of failed logins against LAPI by reason",
+			[]string{"instance", "reason"},
+			nil,
+		),
+		LastLogin: prometheus.NewDesc(
+			"cs_lapi_last_login_timestamp_seconds",
+			"Unix time of the last successful LAPI login",
+			[]string{"instance"},
+			nil,
+		),
+		Registered: prometheus.NewDesc(
+			"cs_lapi_machine_registered",
+			"Whether the machine is registered with LAPI (1) or not (0)",
+			[]string{"instance"},
+			nil,
+		),
+		Alert: prometheus.NewDesc(
+			"cs_lapi_alert",
+			"CrowdSec alert information",
+			[]string{"instance", "id", "scenario", "machine_id", "scope", "value", "simulated", "remediation"},
+			nil,
+		),
+		AlertEvents: prometheus.NewDesc(
+			"cs_lapi_alert_events_count",
+			"Number of events that triggered the alert",
+			[]string{"instance", "id", "scenario"},
+			nil,
+		),
+		AlertCapacity: prometheus.NewDesc(
+			"cs_lapi_alert_capacity",
+			"Bucket capacity of the scenario that triggered the alert",
+			[]string{"instance", "id", "scenario"},
+			nil,
+		),
+		AlertLeakspeed: prometheus.NewDesc(
+			"cs_lapi_alert_leakspeed_seconds",
+			"Bucket leak speed of the scenario that triggered the alert",
+			[]string{"instance", "id", "scenario"},
+			nil,
+		),
+		AlertsTotal: prometheus.NewDesc(
+			"cs_lapi_alerts_total",
+			"Number of alerts read from LAPI since the exporter started, by scenario, machine and source scope",
+			[]string{"instance", "scenario", "machine_id", "scope"},
+			nil,
+		),
+		DecisionsActive: prometheus.NewDesc(
+			"cs_lapi_decisions_active",
+			"Number of decisions by scenario, type and origin",
+			[]string{"instance", "scenario", "type", "origin"},
+			nil,
+		),
+		DecisionsByCountry: prometheus.NewDesc(
+			"cs_lapi_decisions_active_by_country",
+			"Number of decisions by source country",
+			[]string{"instance", "country"},
+			nil,
+		),
+		DecisionsByASN: prometheus.NewDesc(
+			"cs_lapi_decisions_active_by_asn",
+			"Number of decisions by source autonomous system",
+			[]string{"instance", "asnumber", "asname"},
+			nil,
+		),
+		EventMeta: prometheus.NewDesc(
+			"cs_lapi_alert_event_meta",
+			"Number of alert events carrying a meta key/value, showing what was being attacked",
+			[]string{"instance", "scenario", "key", "value"},
+			nil,
+		),
+		RequestRetries: prometheus.NewDesc(
+			"cs_lapi_request_retries_total",
+			"Number of LAPI requests retried after a network error, 429 or 5xx response, by endpoint",
+			[]string{"instance", "endpoint"},
+			nil,
+		),
+		SnapshotAge: prometheus.NewDesc(
+			"cs_lapi_snapshot_age_seconds",
+			"Seconds since the snapshot served to scrapes was read from LAPI",
+			[]string{"instance"},
+			nil,
+		),
+		SnapshotStale: prometheus.NewDesc(
+			"cs_lapi_snapshot_stale",
+			"Whether the snapshot served to scrapes is out of date because polling LAPI failed (1) or not (0)",
+			[]string{"instance"},
+			nil,
+		),
+		Up: prometheus.NewDesc(
+			"cs_lapi_up",
+			"Whether the last read from LAPI succeeded (1) or not (0)",
+			[]string{"instance"},
+			nil,
+		),
+		LastSuccess: prometheus.NewDesc(
+			"cs_exporter_last_success_timestamp_seconds",
+			"Unix time of the last successful read from LAPI",
+			[]string{"instance"},
+			nil,
+		),
+		Errors: prometheus.NewDesc(
+			"cs_exporter_errors_total",
+			"Number of failed reads from LAPI by error type",
+			[]string{"instance", "type"},
+			nil,
+		),
+		AlertsProcessed: prometheus.NewDesc(
+			"cs_exporter_alerts_processed",
+			"Number of alerts in the last read from LAPI",
+			[]string{"instance"},
+			nil,
+		),
+		DecisionsProcessed: prometheus.NewDesc(
+			"cs_exporter_decisions_processed",
+			"Number of decisions in the last read from LAPI",
+			[]string{"instance"},
+			nil,
+		),
+		CapReached: prometheus.NewDesc(
+			"cs_lapi_query_cap_reached",
+			"Whether the last scrape left alerts or decisions unread because crowdsec.max_results was reached (1) or not (0)",
+			[]string{"instance"},
 			nil,
 		),
 	}
 
 	exporter := &Exporter{
-		config:  cfg,
-		metrics: metrics,
+		config:      cfg,
+		client:      client,
+		metrics:     metrics,
+		fetchErrors: make(map[string]uint64),
+		alertCounts: make(map[alertKey]uint64),
+		labels:      labels,
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "cs_lapi_request_duration_seconds",
+			Help:        "Duration of LAPI requests by endpoint and status",
+			ConstLabels: prometheus.Labels{"instance": cfg.Exporter.InstanceName},
+			Buckets:     requestDurationBuckets,
+		}, []string{"endpoint", "status"}),
 	}
+	client.SetRequestObserver(exporter.observeRequest)
 
-	// Register the exporter as a Prometheus collector
-	prometheus.MustRegister(exporter)
-
+	// Not registered globally: Handler collects it per scrape to bound LAPI requests by the scrape timeout
 	return exporter, nil
 }
 
 // Describe implements prometheus.Collector interface
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.metrics.DecisionInfo
+	ch <- e.metrics.DecisionExpiry
+	ch <- e.metrics.ForcedReauths
+	ch <- e.metrics.TokenExpiry
+	ch <- e.metrics.TokenExpirySeconds
+	ch <- e.metrics.LoginAttempts
+	ch <- e.metrics.LoginFailures
+	ch <- e.metrics.LastLogin
+	ch <- e.metrics.Registered
+	ch <- e.metrics.CapReached
+	ch <- e.metrics.RequestRetries
+	ch <- e.metrics.Up
+	ch <- e.metrics.LastSuccess
+	ch <- e.metrics.Errors
+	e.requestDuration.Describe(ch)
+	ch <- e.metrics.AlertsProcessed
+	ch <- e.metrics.DecisionsProcessed
+	if e.config.Exporter.Events.Enabled {
+		ch <- e.metrics.EventMeta
+	}
+	if e.config.Exporter.AlertMetrics {
+		ch <- e.metrics.Alert
+		ch <- e.metrics.AlertEvents
+		ch <- e.metrics.AlertCapacity
+		ch <- e.metrics.AlertLeakspeed
+		ch <- e.metrics.AlertsTotal
+	}
+	if e.config.Exporter.Aggregates.Active {
+		ch <- e.metrics.DecisionsActive
+	}
+	if e.config.Exporter.Aggregates.ByCountry {
+		ch <- e.metrics.DecisionsByCountry
+	}
+	if e.config.Exporter.Aggregates.ByASN {
+		ch <- e.metrics.DecisionsByASN
+	}
+	if e.config.Exporter.PollInterval > 0 {
+		ch <- e.metrics.SnapshotAge
+		ch <- e.metrics.SnapshotStale
+	}
 }
 
-// Collect implements prometheus.Collector interface
-// This is called every time /metrics is accessed
+// Collect implements prometheus.Collector interface, bounding LAPI requests by
+// crowdsec.request_timeout. Handler uses the scrape timeout instead.
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	if e.config.IsDebugEnabled() {
-		slog.Debug("Scraping CrowdSec API for alerts and decisions")
+	ctx, cancel := e.client.RequestContext(context.Background())
+	defer cancel()
+	e.collect(ctx, ch)
+}
+
+// collect queries LAPI within ctx and sends every metric
+func (e *Exporter) collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	defer e.collectRetries(ch)
+	e.collectAuth(ch)
+
+	// With polling enabled scrapes are served from the snapshot and never wait on LAPI
+	if e.config.Exporter.PollInterval > 0 {
+		e.collectSnapshot(ch)
+		return
 	}
 
-	// Get alerts with decisions
-	alerts, err := crowdsec.ReturnAlerts(1000)
+	snap, err := e.fetch(ctx)
+	// After the data, so the request durations include this scrape's own requests
+	defer e.collectHealth(ch, snap, err == nil)
 	if err != nil {
-		slog.Error("Error fetching alerts", "error", err)
+		slog.Error("Error fetching from LAPI", "error", err)
 		return
 	}
+	e.collectData(ch, snap)
+}
+
+// collectAuth exports the client's authentication health.
+// Bouncer API keys hold no token, so only watchers report it.
+func (e *Exporter) collectAuth(ch chan<- prometheus.Metric) {
+	if e.config.CrowdSec.AuthMode() == config.AuthModeAPIKey {
+		return
+	}
+
+	instance := e.config.Exporter.InstanceName
+	stats := e.client.AuthStats()
+
+	ch <- prometheus.MustNewConstMetric(e.metrics.ForcedReauths, prometheus.CounterValue, float64(stats.ForcedReauths), instance)
+	ch <- prometheus.MustNewConstMetric(e.metrics.LoginAttempts, prometheus.CounterValue, float64(stats.LoginAttempts), instance)
+	for reason, count := range stats.LoginFailures {
+		ch <- prometheus.MustNewConstMetric(e.metrics.LoginFailures, prometheus.CounterValue, float64(count), instance, reason)
+	}
+	ch <- prometheus.MustNewConstMetric(e.metrics.Registered, prometheus.GaugeValue, boolToFloat(stats.Registered), instance)
+
+	if !stats.LastLogin.IsZero() {
+		ch <- prometheus.MustNewConstMetric(e.metrics.LastLogin, prometheus.GaugeValue, float64(stats.LastLogin.Unix()), instance)
+		ch <- prometheus.MustNewConstMetric(e.metrics.TokenExpiry, prometheus.GaugeValue, float64(stats.TokenExpire.Unix()), instance)
+		ch <- prometheus.MustNewConstMetric(e.metrics.TokenExpirySeconds, prometheus.GaugeValue, time.Until(stats.TokenExpire).Seconds(), instance)
+	}
+}
+
+// collectRetries exports the client's retry counters, after the scrape's own requests
+func (e *Exporter) collectRetries(ch chan<- prometheus.Metric) {
+	for endpoint, count := range e.client.RetryStats() {
+		ch <- prometheus.MustNewConstMetric(e.metrics.RequestRetries, prometheus.CounterValue, float64(count), e.config.Exporter.InstanceName, endpoint)
+	}
+}
+
+// collectData exports the decisions held in snap, and their alerts, events and counts when enabled
+func (e *Exporter) collectData(ch chan<- prometheus.Metric, snap *snapshot) {
+	e.collectCapReached(ch, snap.truncated)
+
+	e.collectDecisions(ch, snap)
+
+	if e.config.Exporter.AlertMetrics {
+		e.collectAlerts(ch, snap.alerts)
+	}
+	if e.config.Exporter.Events.Enabled {
+		e.collectEvents(ch, snap.alerts)
+	}
+	e.collectAggregates(ch, snap)
+
+	if e.config.IsDebugEnabled() {
+		slog.Debug("Updated metrics", "alert_count", len(snap.alerts), "decision_count", len(snap.decisions))
+	}
+}
+
+// collectCapReached reports whether the last fetch stopped at crowdsec.max_results
+func (e *Exporter) collectCapReached(ch chan<- prometheus.Metric, truncated bool) {
+	if truncated {
+		slog.Warn("Not every alert or decision was read, raise crowdsec.max_results", "max_results", e.config.CrowdSec.MaxResults)
+	}
+	ch <- prometheus.MustNewConstMetric(e.metrics.CapReached, prometheus.GaugeValue, boolToFloat(truncated), e.config.Exporter.InstanceName)
+}
+
+// eventMetaKey identifies one cs_lapi_alert_event_meta series
+type eventMetaKey struct {
+	scenario, key, value string
+}
 
-	// Process alerts and update metrics
+// collectEvents counts the configured meta keys across every alert event
+func (e *Exporter) collectEvents(ch chan<- prometheus.Metric, alerts models.Alerts) {
+	wanted := make(map[string]bool, len(e.config.Exporter.Events.MetaKeys))
+	for _, key := range e.config.Exporter.Events.MetaKeys {
+		wanted[key] = true
+	}
+
+	counts := make(map[eventMetaKey]int)
 	for _, alert := range alerts {
-		for _, decision := range alert.Decisions {
-			decisionTime := parseDecisionTime(alert, decision)
-
-			metric := prometheus.MustNewConstMetric(
-				e.metrics.DecisionInfo,
-				prometheus.GaugeValue,
-				1,
-				e.config.Exporter.InstanceName,
-				fmt.Sprintf("%d", decision.ID),
-				decision.Country,
-				decision.AsName,
-				decision.AsNumber,
-				formatFloat(decision.Latitude),
-				formatFloat(decision.Longitude),
-				decision.IPRange,
-				decision.Scenario,
-				decision.Type,
-				decision.Duration,
-				decision.Scope,
-				decision.IPAddress,
-			)
-
-			if !decisionTime.IsZero() {
-				ch <- prometheus.NewMetricWithTimestamp(decisionTime, metric)
-				continue
+		for _, event := range alert.Events {
+			for _, meta := range event.Meta {
+				if wanted[meta.Key] {
+					counts[eventMetaKey{alert.Scenario, meta.Key, meta.Value}]++
+				}
 			}
-
-			ch <- metric
 		}
 	}
 
-	if e.config.IsDebugEnabled() {
-		slog.Debug("Updated metrics", "alert_count", len(alerts))
+	for k, count := range counts {
+		ch <- prometheus.MustNewConstMetric(
+			e.metrics.EventMeta,
+			prometheus.GaugeValue,
+			float64(count),
+			e.config.Exporter.InstanceName,
+			k.scenario,
+			k.key,
+			k.value,
+		)
 	}
 }
 
-// initCrowdSecClient initializes the CrowdSec API client
-func initCrowdSecClient(cfg *config.Config) error {
-	// Initialize CrowdSec client with the modern config
-	crowdsec.InitializeToken(cfg)
-	return nil
+// boolToFloat converts a bool to a gauge value
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
 }
 
 // formatFloat converts float64 to string for labels
@@ -132,6 +442,21 @@ func formatFloat(f float64) string {
 	return fmt.Sprintf("%.6f", f)
 }
 
+// formatCoordinates returns empty labels when LAPI provided no location
+func formatCoordinates(decision models.Decision) (string, string) {
+	if decision.Latitude == 0 && decision.Longitude == 0 {
+		return "", ""
+	}
+	return formatFloat(decision.Latitude), formatFloat(decision.Longitude)
+}
+
+// expired reports whether decision lapsed before now. Alerts are returned long after
+// their decisions end, so their expired decisions must not count as active.
+func expired(decision models.Decision, now time.Time) bool {
+	until, err := time.Parse(time.RFC3339, decision.Until)
+	return err == nil && until.Before(now)
+}
+
 func parseDecisionTime(alert models.Alert, decision models.Decision) time.Time {
 	// Try decision created_at first, then alert created_at
 	candidates := []string{decision.CreatedAt, alert.CreatedAt}
@@ -1,9 +1,11 @@
 package exporter
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -11,6 +13,7 @@ import (
 	"time"
 
 	"github.com/hydazz/crowdsec-exporter/internal/config"
+	"github.com/hydazz/crowdsec-exporter/internal/crowdsec"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -30,6 +33,23 @@ func newResponse(status int, body string) *http.Response {
 	}
 }
 
+// useTestRegistry swaps the default Prometheus registry for the duration of the test
+func useTestRegistry(t *testing.T) *prometheus.Registry {
+	t.Helper()
+
+	originalRegisterer := prometheus.DefaultRegisterer
+	originalGatherer := prometheus.DefaultGatherer
+	registry := prometheus.NewRegistry()
+	prometheus.DefaultRegisterer = registry
+	prometheus.DefaultGatherer = registry
+	t.Cleanup(func() {
+		prometheus.DefaultRegisterer = originalRegisterer
+		prometheus.DefaultGatherer = originalGatherer
+	})
+
+	return registry
+}
+
 // TestMultipleScrapes ensures exporter survives consecutive scrapes.
 func TestMultipleScrapes(t *testing.T) {
 	var loginCalls int32
@@ -51,7 +71,7 @@ func TestMultipleScrapes(t *testing.T) {
 			if got := req.Header.Get("Authorization"); got != "Bearer test-token" {
 				return nil, fmt.Errorf("unexpected authorization header: %q", got)
 			}
-			payload := `[{"scenario":"test","created_at":"2025-01-01T00:00:00Z","source":{"ip":"1.2.3.4"},"decisions":[{"uuid":"uuid","scenario":"test","value":"1.2.3.4","type":"ban","duration":"1h","scope":"ip","until":"2025-01-02T00:00:00Z","created_at":"2025-01-01T00:00:00Z"}]}]`
+			payload := `[{"scenario":"test","created_at":"2025-01-01T00:00:00Z","source":{"ip":"1.2.3.4"},"decisions":[{"uuid":"uuid","scenario":"test","value":"1.2.3.4","type":"ban","duration":"1h","scope":"ip","until":"2099-01-02T00:00:00Z","created_at":"2025-01-01T00:00:00Z"}]}]`
 			resp := newResponse(http.StatusOK, payload)
 			resp.Header.Set("Content-Type", "application/json")
 			return resp, nil
@@ -60,19 +80,7 @@ func TestMultipleScrapes(t *testing.T) {
 		}
 	})
 
-	originalClient := http.DefaultClient
-	http.DefaultClient = &http.Client{Transport: fakeTransport}
-	defer func() { http.DefaultClient = originalClient }()
-
-	originalRegisterer := prometheus.DefaultRegisterer
-	originalGatherer := prometheus.DefaultGatherer
-	registry := prometheus.NewRegistry()
-	prometheus.DefaultRegisterer = registry
-	prometheus.DefaultGatherer = registry
-	t.Cleanup(func() {
-		prometheus.DefaultRegisterer = originalRegisterer
-		prometheus.DefaultGatherer = originalGatherer
-	})
+	registry := useTestRegistry(t)
 
 	cfg := &config.Config{
 		CrowdSec: config.CrowdSecConfig{
@@ -91,13 +99,15 @@ func TestMultipleScrapes(t *testing.T) {
 		LogLevel: "debug",
 	}
 
-	exp, err := New(cfg)
+	client, err := crowdsec.NewClient(cfg, crowdsec.WithHTTPClient(&http.Client{Transport: fakeTransport}))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	exp, err := New(cfg, client)
 	if err != nil {
 		t.Fatalf("failed to create exporter: %v", err)
 	}
-	t.Cleanup(func() {
-		prometheus.Unregister(exp)
-	})
+	registry.MustRegister(exp)
 
 	const parallel = 5
 	const iterations = 20
@@ -142,3 +152,419 @@ func TestMultipleScrapes(t *testing.T) {
 		t.Fatalf("expected timestamp %d not found in metrics", expectedTime.UnixMilli())
 	}
 }
+
+// TestBouncerDecisions ensures API key mode reads /v1/decisions and leaves geo labels empty.
+func TestBouncerDecisions(t *testing.T) {
+	cfg := &config.Config{CrowdSec: config.CrowdSecConfig{APIKey: "bouncer-key"}}
+	exp := newTestExporter(t, cfg, func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/v1/decisions" {
+			return nil, fmt.Errorf("unexpected path: %s", req.URL.Path)
+		}
+		if got := req.Header.Get("X-Api-Key"); got != "bouncer-key" {
+			return nil, fmt.Errorf("unexpected api key header: %q", got)
+		}
+		if got := req.Header.Get("Authorization"); got != "" {
+			return nil, fmt.Errorf("unexpected authorization header: %q", got)
+		}
+		payload := `[{"id":7,"origin":"cscli","type":"ban","scope":"Ip","value":"5.6.7.8","duration":"3h59m","until":"2099-01-01T04:00:00Z","scenario":"manual ban"}]`
+		return newResponse(http.StatusOK, payload), nil
+	})
+
+	got := gatherSamples(t, exp)
+	// Geo, range and full duration labels are empty: bouncer keys only read the decision
+	const labels = "{asname=,asnumber=,country=,duration=,id=7,ip=5.6.7.8,iprange=,latitude=,longitude=,scenario=manual ban,scope=Ip,type=ban}"
+	assertSamples(t, got, map[string]float64{
+		"cs_lapi_decision" + labels:                          1,
+		"cs_lapi_decision_expiry_timestamp_seconds" + labels: float64(time.Date(2099, 1, 1, 4, 0, 0, 0, time.UTC).Unix()),
+	})
+	if keys := seriesNamed(got, "cs_lapi_decision"); len(keys) != 1 {
+		t.Fatalf("expected one decision, got %v", keys)
+	}
+}
+
+// TestEventMetadata ensures event meta values are counted per scenario when enabled.
+func TestEventMetadata(t *testing.T) {
+	payload := `[{"scenario":"crowdsecurity/http-probing","created_at":"2025-01-01T00:00:00Z","source":{"ip":"1.2.3.4"},"events":[
+		{"timestamp":"2025-01-01T00:00:00Z","meta":[{"key":"target_fqdn","value":"shop.example"},{"key":"http_path","value":"/admin"},{"key":"source_ip","value":"1.2.3.4"}]},
+		{"timestamp":"2025-01-01T00:00:01Z","meta":[{"key":"target_fqdn","value":"shop.example"},{"key":"http_path","value":"/.env"}]}
+	]}]`
+	cfg := &config.Config{Exporter: config.ExporterConfig{
+		Events: config.EventsConfig{Enabled: true, MetaKeys: []string{"target_fqdn", "http_path"}},
+	}}
+	got := gatherSamples(t, newTestExporter(t, cfg, alertsTransport(payload, nil)))
+
+	assertSamples(t, got, map[string]float64{
+		"cs_lapi_alert_event_meta{key=target_fqdn,scenario=crowdsecurity/http-probing,value=shop.example}": 2,
+		"cs_lapi_alert_event_meta{key=http_path,scenario=crowdsecurity/http-probing,value=/admin}":         1,
+		"cs_lapi_alert_event_meta{key=http_path,scenario=crowdsecurity/http-probing,value=/.env}":          1,
+	})
+	if keys := seriesNamed(got, "cs_lapi_alert_event_meta"); len(keys) != 3 {
+		t.Fatalf("unexpected event meta series: %v", keys)
+	}
+}
+
+// TestScrapeTimeout ensures LAPI requests are cancelled when the Prometheus scrape timeout passes.
+func TestScrapeTimeout(t *testing.T) {
+	cancelled := make(chan struct{})
+	fakeTransport := roundTripper(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/v1/watchers/login":
+			payload := fmt.Sprintf(`{"token":"test-token","expire":"%s"}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+			return newResponse(http.StatusOK, payload), nil
+		case "/v1/alerts":
+			// Simulate a hung LAPI that only gives up when the request is cancelled
+			<-req.Context().Done()
+			close(cancelled)
+			return nil, req.Context().Err()
+		default:
+			return nil, fmt.Errorf("unexpected path: %s", req.URL.Path)
+		}
+	})
+
+	cfg := &config.Config{
+		CrowdSec: config.CrowdSecConfig{Retries: 5},
+		Server:   config.ServerConfig{ScrapeTimeoutOffset: 900 * time.Millisecond},
+	}
+	exp := newTestExporter(t, cfg, fakeTransport)
+	// Handler also serves and instruments the default registry
+	useTestRegistry(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "1")
+	rec := httptest.NewRecorder()
+
+	start := time.Now()
+	exp.Handler().ServeHTTP(rec, req)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("expected the scrape to stop after about 100ms, took %s", elapsed)
+	}
+	select {
+	case <-cancelled:
+	default:
+		t.Fatalf("expected the LAPI request to be cancelled")
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the remaining metrics to be served, got status %d", rec.Code)
+	}
+}
+
+// TestPolledSnapshot ensures scrapes are served from the last good snapshot when polling fails.
+func TestPolledSnapshot(t *testing.T) {
+	var decisionCalls int32
+	var failing atomic.Bool
+	cfg := &config.Config{
+		CrowdSec: config.CrowdSecConfig{APIKey: "bouncer-key"},
+		Exporter: config.ExporterConfig{PollInterval: time.Minute},
+	}
+	exp := newTestExporter(t, cfg, func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&decisionCalls, 1)
+		if failing.Load() {
+			return newResponse(http.StatusBadGateway, `bad gateway`), nil
+		}
+		payload := `[{"id":7,"origin":"cscli","type":"ban","scope":"Ip","value":"5.6.7.8","until":"2099-01-01T04:00:00Z","scenario":"manual ban"}]`
+		return newResponse(http.StatusOK, payload), nil
+	})
+
+	gather := func() (decisions int, stale float64) {
+		t.Helper()
+		got := gatherSamples(t, exp)
+		return len(seriesNamed(got, "cs_lapi_decision")), got["cs_lapi_snapshot_stale"].value
+	}
+
+	if decisions, stale := gather(); decisions != 0 || stale != 1 {
+		t.Fatalf("expected no decisions and a stale snapshot before the first poll, got %d and %v", decisions, stale)
+	}
+
+	exp.poll(context.Background())
+	if decisions, stale := gather(); decisions != 1 || stale != 0 {
+		t.Fatalf("expected 1 fresh decision, got %d and stale %v", decisions, stale)
+	}
+
+	failing.Store(true)
+	exp.poll(context.Background())
+	if decisions, stale := gather(); decisions != 1 || stale != 1 {
+		t.Fatalf("expected the previous decision to be kept and marked stale, got %d and stale %v", decisions, stale)
+	}
+
+	if got := atomic.LoadInt32(&decisionCalls); got != 2 {
+		t.Fatalf("expected LAPI to be queried by the 2 polls only, got %d requests", got)
+	}
+}
+
+// alertsTransport serves a machine login and payload as every /v1/alerts page,
+// appending each alerts query to queries when it is not nil
+func alertsTransport(payload string, queries *[]string) roundTripper {
+	return func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/v1/watchers/login":
+			login := fmt.Sprintf(`{"token":"test-token","expire":"%s"}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+			return newResponse(http.StatusOK, login), nil
+		case "/v1/alerts":
+			if queries != nil {
+				*queries = append(*queries, req.URL.RawQuery)
+			}
+			return newResponse(http.StatusOK, payload), nil
+		default:
+			return nil, fmt.Errorf("unexpected path: %s", req.URL.Path)
+		}
+	}
+}
+
+// newTestExporter builds an exporter reaching LAPI through rt. The URL and instance
+// name are filled in, and a machine login unless cfg sets a bouncer API key, before
+// cfg is validated as at startup.
+func newTestExporter(t *testing.T, cfg *config.Config, rt roundTripper) *Exporter {
+	t.Helper()
+
+	cfg.CrowdSec.URL = "http://crowdsec.local"
+	if cfg.CrowdSec.APIKey == "" {
+		cfg.CrowdSec.Login, cfg.CrowdSec.Password = "machine", "password"
+	}
+	cfg.Exporter.InstanceName = "instance"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+
+	client, err := crowdsec.NewClient(cfg, crowdsec.WithHTTPClient(&http.Client{Transport: rt}))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	exp, err := New(cfg, client)
+	if err != nil {
+		t.Fatalf("failed to create exporter: %v", err)
+	}
+	return exp
+}
+
+// sample is one gathered series: its value, or sample count for histograms, and timestamp
+type sample struct {
+	value       float64
+	timestampMs int64
+}
+
+// gatherSamples scrapes exp once and keys every series by its name and labels
+// other than instance, e.g. cs_lapi_alerts{machine_id=agent,scenario=ssh-bf,scope=Ip}
+func gatherSamples(t *testing.T, exp *Exporter) map[string]sample {
+	t.Helper()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exp)
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("gather failed: %v", err)
+	}
+
+	samples := make(map[string]sample)
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			var labels []string
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() != "instance" {
+					labels = append(labels, lp.GetName()+"="+lp.GetValue())
+				}
+			}
+			key := mf.GetName()
+			if len(labels) > 0 {
+				key += "{" + strings.Join(labels, ",") + "}"
+			}
+
+			s := sample{timestampMs: m.GetTimestampMs()}
+			switch {
+			case m.Gauge != nil:
+				s.value = m.GetGauge().GetValue()
+			case m.Counter != nil:
+				s.value = m.GetCounter().GetValue()
+			case m.Histogram != nil:
+				s.value = float64(m.GetHistogram().GetSampleCount())
+			}
+			samples[key] = s
+		}
+	}
+	return samples
+}
+
+// assertSamples fails unless each wanted series was gathered with its value
+func assertSamples(t *testing.T, got map[string]sample, want map[string]float64) {
+	t.Helper()
+	for key, value := range want {
+		s, ok := got[key]
+		if !ok {
+			t.Fatalf("expected %s to be gathered", key)
+		}
+		if s.value != value {
+			t.Fatalf("expected %s to be %v, got %v", key, value, s.value)
+		}
+	}
+}
+
+// seriesNamed returns the gathered series keys of metric name
+func seriesNamed(got map[string]sample, name string) []string {
+	var keys []string
+	for key := range got {
+		if key == name || strings.HasPrefix(key, name+"{") {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// TestHealthMetrics ensures failed reads from LAPI are reported by cs_lapi_up and counted by type.
+func TestHealthMetrics(t *testing.T) {
+	var failing atomic.Bool
+	exp := newTestExporter(t, &config.Config{CrowdSec: config.CrowdSecConfig{APIKey: "bouncer-key"}}, func(req *http.Request) (*http.Response, error) {
+		if failing.Load() {
+			return newResponse(http.StatusInternalServerError, "boom"), nil
+		}
+		return newResponse(http.StatusOK, `[{"id":1,"scenario":"test","value":"1.2.3.4","type":"ban","scope":"ip","duration":"1h"}]`), nil
+	})
+
+	got := gatherSamples(t, exp)
+	assertSamples(t, got, map[string]float64{
+		"cs_lapi_up":                                 1,
+		"cs_exporter_decisions_processed":            1,
+		"cs_exporter_errors_total{type=http_status}": 0,
+		"cs_lapi_request_duration_seconds{endpoint=/v1/decisions,status=200}": 1,
+	})
+	if got["cs_exporter_last_success_timestamp_seconds"].value == 0 {
+		t.Fatalf("expected a last success timestamp")
+	}
+
+	failing.Store(true)
+	got = gatherSamples(t, exp)
+	assertSamples(t, got, map[string]float64{
+		"cs_lapi_up": 0,
+		"cs_exporter_errors_total{type=http_status}":                          1,
+		"cs_lapi_request_duration_seconds{endpoint=/v1/decisions,status=500}": 1,
+	})
+	if _, ok := got["cs_exporter_decisions_processed"]; ok {
+		t.Fatalf("expected no processed count after a failed read")
+	}
+}
+
+// TestDecisionAggregates ensures only the enabled decision counts are exported, without expired decisions.
+func TestDecisionAggregates(t *testing.T) {
+	payload := `[
+		{"id":1,"scenario":"ssh-bf","created_at":"2025-01-01T00:00:00Z","source":{"ip":"1.2.3.4","cn":"FR","as_number":"12322","as_name":"Free SAS"},
+			"decisions":[{"id":1,"scenario":"ssh-bf","value":"1.2.3.4","type":"ban","origin":"crowdsec","scope":"Ip","duration":"4h"}]},
+		{"id":2,"scenario":"ssh-bf","created_at":"2025-01-01T00:00:00Z","source":{"ip":"5.6.7.8","cn":"FR","as_number":"3215","as_name":"Orange"},
+			"decisions":[{"id":2,"scenario":"ssh-bf","value":"5.6.7.8","type":"ban","origin":"crowdsec","scope":"Ip","duration":"4h"}]},
+		{"id":3,"scenario":"http-probing","created_at":"2025-01-01T00:00:00Z","source":{"ip":"9.9.9.9","cn":"US","as_number":"19281","as_name":"Quad9"},
+			"decisions":[{"id":3,"scenario":"http-probing","value":"9.9.9.9","type":"captcha","origin":"crowdsec","scope":"Ip","duration":"1h"}]},
+		{"id":4,"scenario":"ssh-bf","created_at":"2025-01-01T00:00:00Z","source":{"ip":"10.0.0.1","cn":"DE","as_number":"3320","as_name":"DTAG"},
+			"decisions":[{"id":4,"scenario":"ssh-bf","value":"10.0.0.1","type":"ban","origin":"crowdsec","scope":"Ip","until":"2025-01-01T04:00:00Z"}]}
+	]`
+	cfg := &config.Config{Exporter: config.ExporterConfig{Aggregates: config.AggregatesConfig{Active: true, ByCountry: true}}}
+	got := gatherSamples(t, newTestExporter(t, cfg, alertsTransport(payload, nil)))
+
+	want := map[string]float64{
+		"cs_lapi_decisions_active{origin=crowdsec,scenario=ssh-bf,type=ban}":           2,
+		"cs_lapi_decisions_active{origin=crowdsec,scenario=http-probing,type=captcha}": 1,
+		"cs_lapi_decisions_active_by_country{country=FR}":                              2,
+		"cs_lapi_decisions_active_by_country{country=US}":                              1,
+	}
+	assertSamples(t, got, want)
+	// The expired decision of alert 4 is left out, so DE has no series
+	if keys := seriesNamed(got, "cs_lapi_decisions_active"); len(keys) != 2 {
+		t.Fatalf("unexpected aggregate series: %v", keys)
+	}
+	if keys := seriesNamed(got, "cs_lapi_decisions_active_by_country"); len(keys) != 2 {
+		t.Fatalf("expected the expired decision to be left out, got %v", keys)
+	}
+	if keys := seriesNamed(got, "cs_lapi_decisions_active_by_asn"); len(keys) != 0 {
+		t.Fatalf("expected the disabled ASN counts to be absent, got %v", keys)
+	}
+}
+
+// TestAlertMetrics ensures alerts without decisions are queried and exported, and counted once each.
+func TestAlertMetrics(t *testing.T) {
+	payload := `[
+		{"id":2,"machine_id":"agent","scenario":"ssh-bf","events_count":7,"capacity":5,"leakspeed":"10s","remediation":true,"created_at":"2025-01-01T00:00:00Z","source":{"scope":"Ip","value":"5.6.7.8","ip":"5.6.7.8"},
+			"decisions":[{"id":2,"scenario":"ssh-bf","value":"5.6.7.8","type":"ban","origin":"crowdsec","scope":"Ip","duration":"4h"}]},
+		{"id":1,"machine_id":"agent","scenario":"ssh-bf","events_count":6,"capacity":5,"leakspeed":"10s","simulated":true,"created_at":"2025-01-01T00:00:00Z","source":{"scope":"Ip","value":"1.2.3.4","ip":"1.2.3.4"}}
+	]`
+	var queries []string
+	rt := func(req *http.Request) (*http.Response, error) {
+		return alertsTransport(payload, &queries)(req)
+	}
+
+	cfg := &config.Config{
+		CrowdSec: config.CrowdSecConfig{Alerts: config.AlertsConfig{Simulated: true}},
+		Exporter: config.ExporterConfig{AlertMetrics: true},
+	}
+	exp := newTestExporter(t, cfg, rt)
+
+	got := gatherSamples(t, exp)
+	assertSamples(t, got, map[string]float64{
+		"cs_lapi_alert{id=1,machine_id=agent,remediation=false,scenario=ssh-bf,scope=Ip,simulated=true,value=1.2.3.4}": 1,
+		"cs_lapi_alert{id=2,machine_id=agent,remediation=true,scenario=ssh-bf,scope=Ip,simulated=false,value=5.6.7.8}": 1,
+		"cs_lapi_alert_events_count{id=1,scenario=ssh-bf}":                                                             6,
+		"cs_lapi_alert_events_count{id=2,scenario=ssh-bf}":                                                             7,
+		"cs_lapi_alert_capacity{id=1,scenario=ssh-bf}":                                                                 5,
+		"cs_lapi_alert_leakspeed_seconds{id=1,scenario=ssh-bf}":                                                        10,
+		"cs_lapi_alerts_total{machine_id=agent,scenario=ssh-bf,scope=Ip}":                                              2,
+	})
+
+	// Without configured origins no origin filter is sent, so alert 1 without a decision is returned
+	if len(queries) != 1 || queries[0] != "limit=1000&simulated=true" {
+		t.Fatalf("unexpected alerts queries: %v", queries)
+	}
+
+	// Alerts already counted are not counted again, new ones are
+	payload = `[
+		{"id":3,"machine_id":"agent","scenario":"ssh-bf","created_at":"2025-01-01T00:01:00Z","source":{"scope":"Ip","value":"9.9.9.9","ip":"9.9.9.9"}},
+		{"id":2,"machine_id":"agent","scenario":"ssh-bf","created_at":"2025-01-01T00:00:00Z","source":{"scope":"Ip","value":"5.6.7.8","ip":"5.6.7.8"}}
+	]`
+	assertSamples(t, gatherSamples(t, exp), map[string]float64{
+		"cs_lapi_alerts_total{machine_id=agent,scenario=ssh-bf,scope=Ip}": 3,
+	})
+}
+
+// TestDecisionLabels ensures decisions sharing the configured labels are merged into one counted series.
+func TestDecisionLabels(t *testing.T) {
+	payload := `[
+		{"id":1,"machine_id":"agent","scenario":"ssh-bf","created_at":"2025-01-01T00:00:00Z","source":{"ip":"1.2.3.4"},
+			"decisions":[{"id":1,"scenario":"ssh-bf","value":"1.2.3.4","type":"ban","origin":"crowdsec","scope":"Ip","until":"2099-01-01T04:00:00Z"}]},
+		{"id":2,"machine_id":"agent","scenario":"ssh-bf","created_at":"2025-01-02T00:00:00Z","source":{"ip":"5.6.7.8"},
+			"decisions":[{"id":2,"scenario":"ssh-bf","value":"5.6.7.8","type":"ban","origin":"crowdsec","scope":"Ip","until":"2099-01-02T04:00:00Z"}]},
+		{"id":3,"machine_id":"agent","scenario":"ssh-bf","created_at":"2025-01-03T00:00:00Z","source":{"ip":"9.9.9.9"},
+			"decisions":[{"id":3,"scenario":"ssh-bf","value":"9.9.9.9","type":"ban","origin":"crowdsec","scope":"Ip","until":"2025-01-03T04:00:00Z"}]}
+	]`
+
+	client, err := crowdsec.NewClient(&config.Config{CrowdSec: config.CrowdSecConfig{URL: "http://crowdsec.local", Login: "machine", Password: "password"}})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	if _, err := New(&config.Config{Exporter: config.ExporterConfig{DecisionLabels: []string{"hostname"}}}, client); err == nil {
+		t.Fatalf("expected an unknown label to be rejected")
+	}
+
+	cfg := &config.Config{Exporter: config.ExporterConfig{DecisionLabels: []string{"scenario", "machine_id"}}}
+	got := gatherSamples(t, newTestExporter(t, cfg, alertsTransport(payload, nil)))
+
+	if keys := seriesNamed(got, "cs_lapi_decision"); len(keys) != 1 {
+		t.Fatalf("expected one merged series, got %v", keys)
+	}
+	s, ok := got["cs_lapi_decision{machine_id=agent,scenario=ssh-bf}"]
+	if !ok {
+		t.Fatalf("expected the merged series to carry only the configured labels, got %v", seriesNamed(got, "cs_lapi_decision"))
+	}
+	if s.value != 2 {
+		t.Fatalf("expected the series to count 2 decisions, got %v", s.value)
+	}
+	if want := time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC).UnixMilli(); s.timestampMs != want {
+		t.Fatalf("expected the latest decision time %d, got %d", want, s.timestampMs)
+	}
+
+	expiry, ok := got["cs_lapi_decision_expiry_timestamp_seconds{machine_id=agent,scenario=ssh-bf}"]
+	if !ok {
+		t.Fatalf("expected the expiry to follow the configured labels, got %v", seriesNamed(got, "cs_lapi_decision_expiry_timestamp_seconds"))
+	}
+	if want := float64(time.Date(2099, 1, 2, 4, 0, 0, 0, time.UTC).Unix()); expiry.value != want {
+		t.Fatalf("expected the latest expiry %v, got %v", want, expiry.value)
+	}
+	for key := range got {
+		if strings.Contains(key, "{ip=") || strings.Contains(key, ",ip=") || strings.Contains(key, "{id=") || strings.Contains(key, ",id=") {
+			t.Fatalf("expected no ip or id label once dropped, got %s", key)
+		}
+	}
+}
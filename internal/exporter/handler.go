@@ -0,0 +1,56 @@
+package exporter
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// scrapeTimeoutHeader carries the timeout Prometheus applies to the scrape
+const scrapeTimeoutHeader = "X-Prometheus-Scrape-Timeout-Seconds"
+
+// Handler serves the default registry together with the exporter's metrics.
+// LAPI requests made for a scrape are cancelled once the timeout announced by
+// Prometheus, minus server.scrape_timeout_offset, has passed.
+func (e *Exporter) Handler() http.Handler {
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := e.scrapeContext(r)
+		defer cancel()
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(scrapeCollector{e, ctx})
+		gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, registry}
+		promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}))
+}
+
+// scrapeContext derives the deadline for a scrape's LAPI requests, falling back
+// to crowdsec.request_timeout when the scraper sends no timeout
+func (e *Exporter) scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	seconds, err := strconv.ParseFloat(r.Header.Get(scrapeTimeoutHeader), 64)
+	if err != nil || seconds <= 0 {
+		return e.client.RequestContext(r.Context())
+	}
+
+	timeout := time.Duration(seconds * float64(time.Second))
+	// Timeouts shorter than the offset are used as is rather than failing every scrape
+	if offset := e.config.Server.ScrapeTimeoutOffset; offset < timeout {
+		timeout -= offset
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// scrapeCollector collects the exporter's metrics within a single scrape's context
+type scrapeCollector struct {
+	*Exporter
+	ctx context.Context
+}
+
+// Collect implements prometheus.Collector interface
+func (s scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	s.collect(s.ctx, ch)
+}
@@ -0,0 +1,131 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"time"
+
+	"github.com/hydazz/crowdsec-exporter/internal/crowdsec"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Error types counted by cs_exporter_errors_total
+const (
+	errorAuth    = "auth"
+	errorTimeout = "timeout"
+	errorStatus  = "http_status"
+	errorNetwork = "network"
+	errorDecode  = "decode"
+	errorStream  = "stream_not_synced"
+	errorOther   = "other"
+)
+
+// errorTypes lists every type reported by cs_exporter_errors_total
+var errorTypes = []string{errorAuth, errorTimeout, errorStatus, errorNetwork, errorDecode, errorStream, errorOther}
+
+// errStreamNotSynced is returned until the decision stream has completed its first poll
+var errStreamNotSynced = errors.New("decision stream has not synced yet")
+
+// errorType classifies a failed fetch for cs_exporter_errors_total
+func errorType(err error) string {
+	var (
+		authErr   *crowdsec.AuthError
+		apiErr    *crowdsec.APIError
+		netErr    net.Error
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return errorTimeout
+	case errors.As(err, &authErr):
+		return errorAuth
+	case errors.As(err, &apiErr):
+		return errorStatus
+	case errors.Is(err, errStreamNotSynced):
+		return errorStream
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return errorDecode
+	case errors.As(err, &netErr):
+		return errorNetwork
+	default:
+		return errorOther
+	}
+}
+
+// recordFetch updates the self-monitoring state after a fetch from LAPI
+func (e *Exporter) recordFetch(snap *snapshot, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err != nil {
+		e.fetchErrors[errorType(err)]++
+		return
+	}
+	e.lastSuccess = snap.fetched
+	if e.config.Exporter.AlertMetrics {
+		e.countAlerts(snap.alerts)
+	}
+}
+
+// collectHealth exports whether LAPI could be read, the size of what was read,
+// and the counters kept across fetches
+func (e *Exporter) collectHealth(ch chan<- prometheus.Metric, snap *snapshot, up bool) {
+	instance := e.config.Exporter.InstanceName
+	ch <- prometheus.MustNewConstMetric(e.metrics.Up, prometheus.GaugeValue, boolToFloat(up), instance)
+
+	if snap != nil {
+		decisions := len(snap.decisions)
+		for _, alert := range snap.alerts {
+			decisions += len(alert.Decisions)
+		}
+		ch <- prometheus.MustNewConstMetric(e.metrics.AlertsProcessed, prometheus.GaugeValue, float64(len(snap.alerts)), instance)
+		ch <- prometheus.MustNewConstMetric(e.metrics.DecisionsProcessed, prometheus.GaugeValue, float64(decisions), instance)
+	}
+
+	e.mu.RLock()
+	lastSuccess := e.lastSuccess
+	fetchErrors := make(map[string]uint64, len(errorTypes))
+	for _, t := range errorTypes {
+		fetchErrors[t] = e.fetchErrors[t]
+	}
+	e.mu.RUnlock()
+
+	if !lastSuccess.IsZero() {
+		ch <- prometheus.MustNewConstMetric(e.metrics.LastSuccess, prometheus.GaugeValue, float64(lastSuccess.Unix()), instance)
+	}
+	for t, count := range fetchErrors {
+		ch <- prometheus.MustNewConstMetric(e.metrics.Errors, prometheus.CounterValue, float64(count), instance, t)
+	}
+
+	e.requestDuration.Collect(ch)
+}
+
+// requestDurationBuckets are the upper bounds, in seconds, of cs_lapi_request_duration_seconds
+var requestDurationBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// observeRequest records the duration of one LAPI request
+func (e *Exporter) observeRequest(endpoint, status string, duration time.Duration) {
+	e.requestDuration.WithLabelValues(endpoint, status).Observe(duration.Seconds())
+}
+
+// NewBuildInfo returns a collector exporting cs_exporter_build_info for the running binary
+func NewBuildInfo(version, commit, date string) prometheus.Collector {
+	info := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cs_exporter_build_info",
+		Help: "Build information of the running exporter, always 1",
+		ConstLabels: prometheus.Labels{
+			"version":   version,
+			"commit":    commit,
+			"date":      date,
+			"goversion": runtime.Version(),
+		},
+	})
+	info.Set(1)
+	return info
+}
@@ -0,0 +1,112 @@
+package exporter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hydazz/crowdsec-exporter/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// decisionLabel extracts one cs_lapi_decision label value from a decision
+type decisionLabel func(models.Decision) string
+
+// decisionLabelValues maps each configurable cs_lapi_decision label to its value
+var decisionLabelValues = map[string]decisionLabel{
+	"id":         func(d models.Decision) string { return strconv.Itoa(d.ID) },
+	"country":    func(d models.Decision) string { return d.Country },
+	"asname":     func(d models.Decision) string { return d.AsName },
+	"asnumber":   func(d models.Decision) string { return d.AsNumber },
+	"latitude":   func(d models.Decision) string { latitude, _ := formatCoordinates(d); return latitude },
+	"longitude":  func(d models.Decision) string { _, longitude := formatCoordinates(d); return longitude },
+	"iprange":    func(d models.Decision) string { return d.IPRange },
+	"scenario":   func(d models.Decision) string { return d.Scenario },
+	"type":       func(d models.Decision) string { return d.Type },
+	"duration":   func(d models.Decision) string { return d.Duration },
+	"scope":      func(d models.Decision) string { return d.Scope },
+	"ip":         func(d models.Decision) string { return d.IPAddress },
+	"origin":     func(d models.Decision) string { return d.Origin },
+	"machine_id": func(d models.Decision) string { return d.MachineID },
+	"until":      func(d models.Decision) string { return d.Until },
+	"simulated":  func(d models.Decision) string { return strconv.FormatBool(d.Simulated) },
+}
+
+// newDecisionLabels returns the extractors for names, rejecting unknown labels
+func newDecisionLabels(names []string) ([]decisionLabel, error) {
+	labels := make([]decisionLabel, 0, len(names))
+	for _, name := range names {
+		label, ok := decisionLabelValues[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown decision label %q", name)
+		}
+		labels = append(labels, label)
+	}
+	return labels, nil
+}
+
+// decisionSeries holds the decisions sharing one set of cs_lapi_decision label values
+type decisionSeries struct {
+	values []string
+	count  int
+	// latest is the most recent decision time, zero when none is known
+	latest time.Time
+	// expiry is the latest expiry, zero when none is known
+	expiry time.Time
+}
+
+// collectDecisions sends one cs_lapi_decision sample per label set, counting its
+// unexpired decisions, along with the latest expiry among them. Without id or ip among the
+// labels several decisions share a series.
+func (e *Exporter) collectDecisions(ch chan<- prometheus.Metric, snap *snapshot) {
+	series := make(map[string]*decisionSeries)
+	now := time.Now()
+	add := func(decision models.Decision, decisionTime time.Time) {
+		if expired(decision, now) {
+			return
+		}
+
+		values := make([]string, 0, len(e.labels)+1)
+		values = append(values, e.config.Exporter.InstanceName)
+		for _, label := range e.labels {
+			values = append(values, label(decision))
+		}
+
+		key := strings.Join(values, "\xff")
+		s, ok := series[key]
+		if !ok {
+			s = &decisionSeries{values: values}
+			series[key] = s
+		}
+		s.count++
+		if decisionTime.After(s.latest) {
+			s.latest = decisionTime
+		}
+		if until, err := time.Parse(time.RFC3339, decision.Until); err == nil && until.After(s.expiry) {
+			s.expiry = until
+		}
+	}
+
+	// Decisions read with a bouncer API key come without their alert
+	for _, decision := range snap.decisions {
+		add(decision, time.Time{})
+	}
+	for _, alert := range snap.alerts {
+		for _, decision := range alert.Decisions {
+			add(decision, parseDecisionTime(alert, decision))
+		}
+	}
+
+	for _, s := range series {
+		metric := prometheus.MustNewConstMetric(e.metrics.DecisionInfo, prometheus.GaugeValue, float64(s.count), s.values...)
+		if !s.latest.IsZero() {
+			metric = prometheus.NewMetricWithTimestamp(s.latest, metric)
+		}
+		ch <- metric
+
+		if !s.expiry.IsZero() {
+			ch <- prometheus.MustNewConstMetric(e.metrics.DecisionExpiry, prometheus.GaugeValue, float64(s.expiry.Unix()), s.values...)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/hydazz/crowdsec-exporter/internal/config"
+	"github.com/hydazz/crowdsec-exporter/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// snapshot holds the LAPI data metrics are rendered from
+type snapshot struct {
+	// alerts are read with machine credentials, decisions with a bouncer API key
+	alerts    models.Alerts
+	decisions models.DecisionArray
+	truncated bool
+	fetched   time.Time
+}
+
+// fetch reads a snapshot from LAPI within ctx and records the outcome
+func (e *Exporter) fetch(ctx context.Context) (*snapshot, error) {
+	snap, err := e.read(ctx)
+	e.recordFetch(snap, err)
+	return snap, err
+}
+
+// read reads a snapshot from LAPI within ctx
+func (e *Exporter) read(ctx context.Context) (*snapshot, error) {
+	snap := &snapshot{fetched: time.Now()}
+
+	var err error
+	switch {
+	// Bouncer keys cannot read alerts, only the decisions endpoint
+	case e.config.CrowdSec.AuthMode() != config.AuthModeAPIKey:
+		if e.config.IsDebugEnabled() {
+			slog.Debug("Scraping CrowdSec API for alerts and decisions")
+		}
+		if snap.alerts, snap.truncated, err = e.client.ReturnAlerts(ctx); err != nil {
+			return nil, fmt.Errorf("fetch alerts: %w", err)
+		}
+	case e.config.CrowdSec.Stream.Enabled:
+		var ok bool
+		if snap.decisions, ok = e.client.StreamedDecisions(); !ok {
+			return nil, errStreamNotSynced
+		}
+	default:
+		if e.config.IsDebugEnabled() {
+			slog.Debug("Scraping CrowdSec API for decisions")
+		}
+		if snap.decisions, snap.truncated, err = e.client.ReturnDecisions(ctx); err != nil {
+			return nil, fmt.Errorf("fetch decisions: %w", err)
+		}
+	}
+
+	return snap, nil
+}
+
+// RunPoller refreshes the snapshot served to scrapes every exporter.poll_interval
+// until ctx is cancelled. A failed poll keeps the previous snapshot, so an LAPI
+// outage marks the series stale instead of removing them.
+func (e *Exporter) RunPoller(ctx context.Context) {
+	interval := e.config.Exporter.PollInterval
+	if interval <= 0 {
+		return
+	}
+
+	slog.Debug("Poller started", "interval", interval)
+	for {
+		e.poll(ctx)
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// poll replaces the snapshot with a fresh one, or flags it stale on failure
+func (e *Exporter) poll(ctx context.Context) {
+	pollCtx, cancel := e.client.RequestContext(ctx)
+	defer cancel()
+
+	snap, err := e.fetch(pollCtx)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err != nil {
+		slog.Warn("Polling LAPI failed, serving the previous snapshot", "error", err)
+		e.pollFailed = true
+		return
+	}
+	e.snapshot = snap
+	e.pollFailed = false
+}
+
+// collectSnapshot exports the last snapshot read by RunPoller along with its age
+func (e *Exporter) collectSnapshot(ch chan<- prometheus.Metric) {
+	e.mu.RLock()
+	snap, failed := e.snapshot, e.pollFailed
+	e.mu.RUnlock()
+
+	instance := e.config.Exporter.InstanceName
+	// A poll stuck for two intervals is as bad as a failed one
+	stale := failed || snap == nil || time.Since(snap.fetched) > 2*e.config.Exporter.PollInterval
+	ch <- prometheus.MustNewConstMetric(e.metrics.SnapshotStale, prometheus.GaugeValue, boolToFloat(stale), instance)
+	e.collectHealth(ch, snap, !failed && snap != nil)
+	if snap == nil {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(e.metrics.SnapshotAge, prometheus.GaugeValue, time.Since(snap.fetched).Seconds(), instance)
+	e.collectData(ch, snap)
+}
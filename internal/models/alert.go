@@ -11,20 +11,36 @@ type MetaItem struct {
 }
 
 type Alert struct {
-	Scenario  string  `json:"scenario"`
-	IPAddress string  `json:"ip"`
-	Subnet    string  `json:"subnet"`
-	DateTime  string  `json:"datetime"`
-	CreatedAt string  `json:"created_at"`
-	StartAt   string  `json:"start_at"`
-	StopAt    string  `json:"stop_at"`
-	Events    []Event `json:"events"`
-	Latitude  float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
-	Country   string  `json:"countryISO"`
-	AsName    string  `json:"asname"`
-	AsNumber  string  `json:"asnumber"`
-	IPRange   string  `json:"iprange"`
+	ID              int64      `json:"id"`
+	UUID            string     `json:"uuid"`
+	MachineID       string     `json:"machine_id"`
+	Scenario        string     `json:"scenario"`
+	ScenarioHash    string     `json:"scenario_hash"`
+	ScenarioVersion string     `json:"scenario_version"`
+	Message         string     `json:"message"`
+	EventsCount     int32      `json:"events_count"`
+	Capacity        int32      `json:"capacity"`
+	Leakspeed       string     `json:"leakspeed"`
+	Simulated       bool       `json:"simulated"`
+	Remediation     bool       `json:"remediation"`
+	Labels          []string   `json:"labels"`
+	Meta            []MetaItem `json:"meta"`
+	// Source scope and value, e.g. Ip / 1.2.3.4 or Range / 1.2.3.0/24
+	SourceScope string  `json:"source_scope"`
+	SourceValue string  `json:"source_value"`
+	IPAddress   string  `json:"ip"`
+	Subnet      string  `json:"subnet"`
+	DateTime    string  `json:"datetime"`
+	CreatedAt   string  `json:"created_at"`
+	StartAt     string  `json:"start_at"`
+	StopAt      string  `json:"stop_at"`
+	Events      []Event `json:"events"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+	Country     string  `json:"countryISO"`
+	AsName      string  `json:"asname"`
+	AsNumber    string  `json:"asnumber"`
+	IPRange     string  `json:"iprange"`
 	// Associated decisions
 	Decisions []Decision `json:"decisions"`
 }
@@ -9,6 +9,9 @@ type Decision struct {
 	Until     string `json:"until"`
 	Duration  string `json:"duration"`
 	Scope     string `json:"scope"`
+	Origin    string `json:"origin"`
+	MachineID string `json:"machine_id"`
+	Simulated bool   `json:"simulated"`
 	CreatedAt string `json:"created_at"`
 	// Geographic and ASN information
 	Country   string  `json:"country"`